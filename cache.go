@@ -0,0 +1,96 @@
+package p0fclient
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// responseCache is a fixed size LRU cache of responses keyed by the query
+// that was sent. It is safe for concurrent use.
+type responseCache struct {
+	size int
+	ttl  time.Duration
+	// now returns the current time; replaced in tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	key     string
+	resp    Response
+	expires time.Time
+}
+
+// newResponseCache returns a cache of up to size responses that are kept for
+// ttl, or nil if size or ttl is not positive.
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+
+	return &responseCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// cacheKey returns the key of query: its address type and address. An
+// IPv4-mapped IPv6 address therefore shares an entry with the IPv4 address
+// only if it is queried as IPv4; see SetMappedAsIPv6.
+func cacheKey(query Query) string {
+	return string(append([]byte{byte(query.AddressType)}, query.Address[:]...))
+}
+
+// get copies the cached response to query into resp. It returns false if
+// there is none or it expired.
+func (c *responseCache) get(query Query, resp *Response) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[cacheKey(query)]
+	if !ok {
+		return false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, entry.key)
+		return false
+	}
+
+	c.order.MoveToFront(elem)
+	*resp = entry.resp
+	return true
+}
+
+// put stores a copy of resp as the response to query, evicting the least
+// recently used response if the cache is full.
+func (c *responseCache) put(query Query, resp *Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(query)
+	expires := c.now().Add(c.ttl)
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.resp, entry.expires = *resp, expires
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, resp: *resp, expires: expires})
+}
@@ -0,0 +1,120 @@
+package p0fclient
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cache := newResponseCache(2, time.Second)
+	cache.now = func() time.Time { return now }
+
+	query := func(ip string, mappedAsIPv6 bool) Query {
+		q, err := createQuery(net.ParseIP(ip), mappedAsIPv6)
+		if err != nil {
+			t.Fatalf("could not create query: %s", err)
+		}
+		return q
+	}
+	a, b, c := query("192.0.2.1", false), query("192.0.2.2", false), query("192.0.2.3", false)
+	cache.put(a, &Response{TotalCount: 1})
+	cache.put(b, &Response{TotalCount: 2})
+
+	var resp Response
+	if !cache.get(a, &resp) || resp.TotalCount != 1 {
+		t.Fatalf("expected a cached response for %s, got %+v", a, resp)
+	}
+	if cache.get(query("::ffff:192.0.2.1", true), &resp) {
+		t.Errorf("expected no cached response for the address queried as IPv6")
+	}
+
+	// b is now the least recently used response and is evicted.
+	cache.put(c, &Response{TotalCount: 3})
+	if cache.get(b, &resp) {
+		t.Errorf("expected %s to be evicted", b)
+	}
+	if !cache.get(c, &resp) || resp.TotalCount != 3 {
+		t.Errorf("expected a cached response for %s, got %+v", c, resp)
+	}
+
+	now = now.Add(time.Second)
+	if cache.get(a, &resp) {
+		t.Errorf("expected the response for %s to expire", a)
+	}
+
+	if newResponseCache(0, time.Second) != nil || newResponseCache(1, 0) != nil {
+		t.Errorf("expected no cache for a zero size or ttl")
+	}
+}
+
+func TestP0fQueryCached(t *testing.T) {
+	var queries atomic.Int32
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		for binary.Read(conn, binary.LittleEndian, &query) == nil {
+			queries.Add(1)
+			if binary.Write(conn, binary.LittleEndian, okResponse) != nil {
+				return
+			}
+		}
+	})
+
+	pc := NewP0fClient(socket, WithCache(10, time.Minute))
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		resp, err := pc.QueryIP(ip)
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if *resp != okResponse {
+			t.Errorf("expected %+v, got %+v", okResponse, resp)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("expected a single query to p0f, got %d", n)
+	}
+
+	// Timed queries measure p0f and bypass the cache.
+	if _, _, err := pc.QueryIPTimed(ip); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("expected the timed query to reach p0f, got %d queries", n)
+	}
+
+	// Queried as IPv6, the mapped form of the address is another host to
+	// p0f and must not get the cached IPv4 answer.
+	pc.SetMappedAsIPv6(true)
+	if _, err := pc.QueryIP(net.ParseIP("::ffff:192.0.2.1")); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if n := queries.Load(); n != 3 {
+		t.Errorf("expected the IPv6 query to reach p0f, got %d queries", n)
+	}
+	pc.SetMappedAsIPv6(false)
+	if _, err := pc.QueryIP(net.ParseIP("::ffff:192.0.2.1")); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if n := queries.Load(); n != 3 {
+		t.Errorf("expected the IPv4 query to be answered from the cache, got %d queries", n)
+	}
+
+	pc.SetCache(0, 0)
+	if _, err := pc.QueryIP(ip); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if n := queries.Load(); n != 4 {
+		t.Errorf("expected the query to reach p0f with the cache disabled, got %d queries", n)
+	}
+}
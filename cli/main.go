@@ -1,48 +1,229 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"strings"
 
 	"github.com/mrheinen/p0fclient"
 )
 
+// Exit codes of the CLI. A query that p0f answers with no match is not an
+// error and exits with exitOK.
+const (
+	exitOK      = 0
+	exitUsage   = 2 // invalid command line
+	exitConnect = 3 // could not connect to the p0f socket
+	exitBadIP   = 4 // an address could not be parsed
+	exitQuery   = 5 // a query failed or timed out
+)
+
+// ipList collects the values of a flag that can be given multiple times.
+type ipList []string
+
+func (l *ipList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *ipList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 var (
-	socketFile = flag.String("s", "", "p0f socket file")
-	ipAddress  = flag.String("ip", "", "IP address to query (IPv4 or IPv6)")
+	socketFile  = flag.String("s", "", "p0f socket file (default: the first of "+strings.Join(p0fclient.DefaultSocketPaths(), ", ")+" that exists)")
+	timeout     = flag.Duration("timeout", 0, "maximum time a query may take, e.g. 2s (0 means no timeout)")
+	workers     = flag.Int("workers", 1, "number of queries to run in parallel, each over its own connection")
+	verbose     = flag.Bool("verbose", false, "print all fields of a response as a table")
+	ipAddresses ipList
 )
 
-func main() {
+func init() {
+	flag.Var(&ipAddresses, "ip", "IP address to query (IPv4 or IPv6), can be given multiple times. If omitted, addresses are read from stdin, one per line")
+	flag.Usage = usage
+}
 
-	flag.Parse()
-	if *socketFile == "" || *ipAddress == "" {
-		fmt.Printf("Usage: %s -socket <socket> -ip <ip>\n", os.Args[0])
-		return
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-s <socket>] [-timeout <duration>] [-workers <n>] [-verbose] [-ip <ip>]...\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(flag.CommandLine.Output(), `
+Exit codes:
+  %d  all queries succeeded (including queries without a match)
+  %d  invalid command line
+  %d  could not connect to the socket
+  %d  an IP address could not be parsed
+  %d  a query failed or timed out
+`, exitOK, exitUsage, exitConnect, exitBadIP, exitQuery)
+}
+
+// result is the output of a single query. It is buffered so that queries
+// running in parallel are printed in the order of the input.
+type result struct {
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+	code   int
+	// fatal is set when the query timed out. The connection can not be used
+	// anymore so no more queries are printed.
+	fatal bool
+}
+
+// print writes the buffered output of the query to stdout and stderr.
+func (r *result) print() {
+	os.Stdout.Write(r.stdout.Bytes())
+	os.Stderr.Write(r.stderr.Bytes())
+}
+
+// queryIP queries a single address and returns the result prefixed with the
+// address. Errors go to stderr and come with the matching exit code.
+func queryIP(q p0fclient.Querier, address string) *result {
+	r := &result{}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		fmt.Fprintf(&r.stderr, "%s: Error: invalid IP address\n", address)
+		r.code = exitBadIP
+		return r
+	}
+
+	res, err := q.QueryIP(ip)
+	if errors.Is(err, p0fclient.ErrTimeout) {
+		fmt.Fprintf(&r.stderr, "%s: Error: query timed out after %s\n", address, *timeout)
+		r.code = exitQuery
+		r.fatal = true
+		return r
+	}
+	if err != nil {
+		fmt.Fprintf(&r.stderr, "%s: Error: %s\n", address, err)
+		r.code = exitQuery
+		return r
+	}
+
+	if *verbose {
+		fmt.Fprintf(&r.stdout, "%s:\n%s", address, res.Table())
+	} else if res.Status == p0fclient.P0F_STATUS_NOMATCH {
+		fmt.Fprintf(&r.stdout, "%s: No match found\n", address)
+	} else {
+		fmt.Fprintf(&r.stdout, "%s: %s\n", address, res)
+	}
+	return r
+}
+
+// readAddresses sends the addresses given with -ip, or read from stdin if
+// there are none, to the returned channel. The channel is closed once all
+// addresses were sent; the error reading stdin, if any, is then stored in
+// readErr.
+func readAddresses(readErr *error) <-chan string {
+	addresses := make(chan string)
+	go func() {
+		defer close(addresses)
+
+		if len(ipAddresses) > 0 {
+			for _, address := range ipAddresses {
+				addresses <- address
+			}
+			return
+		}
+
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if address := strings.TrimSpace(scanner.Text()); address != "" {
+				addresses <- address
+			}
+		}
+		*readErr = scanner.Err()
+	}()
+	return addresses
+}
+
+// queryAll queries every address with up to workers queries running at the
+// same time. The results are sent in the order of the addresses.
+func queryAll(q p0fclient.Querier, addresses <-chan string, workers int) <-chan chan *result {
+	pending := make(chan chan *result, workers-1)
+	go func() {
+		defer close(pending)
+		for address := range addresses {
+			r := make(chan *result, 1)
+			pending <- r
+			go func(address string) {
+				r <- queryIP(q, address)
+			}(address)
+		}
+	}()
+	return pending
+}
+
+// connect opens a single connection, or a pool of connections if more than
+// one worker is used. The returned function closes them again.
+func connect() (p0fclient.Querier, func(), error) {
+	opts := []p0fclient.Option{p0fclient.WithTimeout(*timeout)}
+	if *workers > 1 {
+		pool := p0fclient.NewP0fPool(*socketFile, *workers, opts...)
+		if err := pool.Connect(); err != nil {
+			return nil, nil, err
+		}
+		return pool, func() { pool.Close() }, nil
 	}
 
-	cli := p0fclient.NewP0fClient(*socketFile)
+	cli := p0fclient.NewP0fClient(*socketFile, opts...)
 	if err := cli.Connect(); err != nil {
-		fmt.Printf("Can't connect to socket: %s\n", err)
-		return
+		return nil, nil, err
 	}
+	return cli, func() { cli.Stop() }, nil
+}
 
-	ip := net.ParseIP(*ipAddress)
-	if ip == nil {
-		fmt.Printf("Error: invalid IP address: %s\n", *ipAddress)
-		return
+func main() {
+	os.Exit(run())
+}
+
+// run executes the CLI and returns the exit code. When querying multiple
+// addresses the code of the first failure is returned.
+func run() int {
+	flag.Parse()
+	if *workers < 1 {
+		flag.Usage()
+		return exitUsage
 	}
 
-	res, err := cli.QueryIP(ip)
+	if *socketFile == "" {
+		socket, err := p0fclient.FindDefaultSocket()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't find socket: %s; use -s to set it\n", err)
+			return exitConnect
+		}
+		*socketFile = socket
+	}
+
+	q, closeConn, err := connect()
 	if err != nil {
-		fmt.Printf("Error: %s\n", err)
-		return
+		fmt.Fprintf(os.Stderr, "Can't connect to socket: %s\n", err)
+		return exitConnect
 	}
+	defer closeConn()
 
-	if res.Status == p0fclient.P0F_STATUS_NOMATCH {
-		fmt.Println("No match found")
-	} else {
-		fmt.Printf("Response: %s\n", res)
+	var readErr error
+	code := exitOK
+	for pending := range queryAll(q, readAddresses(&readErr), *workers) {
+		r := <-pending
+		r.print()
+		if code == exitOK {
+			code = r.code
+		}
+		if r.fatal {
+			return code
+		}
 	}
+
+	if readErr != nil {
+		fmt.Fprintf(os.Stderr, "Error reading stdin: %s\n", readErr)
+		if code == exitOK {
+			code = exitQuery
+		}
+	}
+
+	return code
 }
@@ -0,0 +1,56 @@
+package p0fclient
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrNoDefaultSocket is returned by NewP0fClientDefault and
+// FindDefaultSocket when none of the paths of DefaultSocketPaths exists.
+var ErrNoDefaultSocket = fmt.Errorf("no p0f socket found at %s", strings.Join(defaultSocketPaths, ", "))
+
+// defaultSocketPaths are the locations where p0f sockets are commonly
+// created, most common first.
+var defaultSocketPaths = []string{
+	"/var/run/p0f.sock",
+	"/tmp/p0f.sock",
+}
+
+// DefaultSocketPaths returns the locations where p0f sockets are commonly
+// created, in the order they are tried by NewP0fClientDefault.
+func DefaultSocketPaths() []string {
+	return append([]string(nil), defaultSocketPaths...)
+}
+
+// FindDefaultSocket returns the first path of DefaultSocketPaths that exists
+// and is a socket. It returns ErrNoDefaultSocket if there is none.
+func FindDefaultSocket() (string, error) {
+	return findSocket(defaultSocketPaths)
+}
+
+// findSocket returns the first of paths that exists and is a socket.
+func findSocket(paths []string) (string, error) {
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.Mode().Type() == os.ModeSocket {
+			return path, nil
+		}
+	}
+	return "", ErrNoDefaultSocket
+}
+
+// NewP0fClientDefault returns a client for the first socket found by
+// FindDefaultSocket and connects it. The paths after the first socket that
+// exists are not tried, even if connecting to it fails.
+func NewP0fClientDefault(opts ...Option) (*P0fClient, error) {
+	socket, err := FindDefaultSocket()
+	if err != nil {
+		return nil, err
+	}
+
+	p := NewP0fClient(socket, opts...)
+	if err := p.Connect(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
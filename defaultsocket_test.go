@@ -0,0 +1,95 @@
+package p0fclient
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindSocket(t *testing.T) {
+	dir := t.TempDir()
+	socket := startTestServer(t, func(conn net.Conn) { conn.Close() })
+	regular := filepath.Join(dir, "regular")
+	if err := os.WriteFile(regular, nil, 0o600); err != nil {
+		t.Fatalf("could not create file: %s", err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	for _, test := range []struct {
+		description string
+		paths       []string
+		expected    string
+		err         error
+	}{
+		{
+			description: "first exists",
+			paths:       []string{socket, missing},
+			expected:    socket,
+		},
+		{
+			description: "skips missing and regular files",
+			paths:       []string{missing, regular, socket},
+			expected:    socket,
+		},
+		{
+			description: "none exists",
+			paths:       []string{missing, regular},
+			err:         ErrNoDefaultSocket,
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := findSocket(test.paths)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+			if got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestDefaultSocketPaths(t *testing.T) {
+	paths := DefaultSocketPaths()
+	if len(paths) == 0 || paths[0] != "/var/run/p0f.sock" {
+		t.Fatalf("unexpected default paths %v", paths)
+	}
+
+	paths[0] = "changed"
+	if DefaultSocketPaths()[0] == "changed" {
+		t.Errorf("expected DefaultSocketPaths to return a copy")
+	}
+}
+
+func TestNewP0fClientDefault(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	orig := defaultSocketPaths
+	defer func() { defaultSocketPaths = orig }()
+
+	defaultSocketPaths = []string{socket, missing}
+	pc, err := NewP0fClientDefault()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	defer pc.Stop()
+	if pc.socketFile != socket {
+		t.Errorf("expected socket %q, got %q", socket, pc.socketFile)
+	}
+	if !pc.IsConnected() {
+		t.Errorf("expected the client to be connected")
+	}
+	if _, err := pc.QueryIP(net.ParseIP("192.0.2.1")); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+
+	defaultSocketPaths = []string{missing}
+	if _, err := NewP0fClientDefault(); !errors.Is(err, ErrNoDefaultSocket) {
+		t.Errorf("expected ErrNoDefaultSocket, got %v", err)
+	}
+}
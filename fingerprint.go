@@ -0,0 +1,70 @@
+package p0fclient
+
+import (
+	"net"
+	"time"
+)
+
+// Fingerprint is a simplified view of a Response that holds what most users
+// need, without NUL padding, raw timestamps or status constants.
+type Fingerprint struct {
+	// Matched is true if p0f knows the host. All other fields are empty
+	// when it is false.
+	Matched bool
+	// OS is the OS name and flavor, for example "Linux 3.11 and newer".
+	OS string
+	// HTTP is the HTTP software name and flavor, for example "Firefox 10.x
+	// or newer".
+	HTTP string
+	// LinkType is the link type p0f derived from the MTU, for example
+	// "Ethernet or modem".
+	LinkType string
+	// Distance is the estimated number of network hops to the host, or nil
+	// if it is unknown.
+	Distance *int
+	// Uptime is the uptime of the host, or nil if it is unknown.
+	Uptime *time.Duration
+}
+
+// Fingerprint returns the simplified view of the response.
+func (r *Response) Fingerprint() *Fingerprint {
+	if !r.IsMatch() {
+		return &Fingerprint{}
+	}
+
+	f := &Fingerprint{
+		Matched:  true,
+		OS:       joinNonEmpty(r.OsNameString(), r.OsFlavorString()),
+		HTTP:     joinNonEmpty(r.HttpNameString(), r.HttpFlavorString()),
+		LinkType: r.LinkTypeString(),
+	}
+	if d, ok := r.HopDistance(); ok {
+		f.Distance = &d
+	}
+	if u, ok := r.Uptime(); ok {
+		f.Uptime = &u
+	}
+	return f
+}
+
+// Lookup queries p0f for the IP address and returns the simplified
+// Fingerprint of the host. A host that p0f does not know is not an error;
+// its Fingerprint has Matched set to false.
+func (p *P0fClient) Lookup(ip net.IP) (*Fingerprint, error) {
+	resp, err := p.QueryIP(ip)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Fingerprint(), nil
+}
+
+// QueryOS queries p0f for the IP address and returns the OS name and flavor,
+// for example "Linux 3.11 and newer". An empty string is returned if p0f
+// does not know the host; an error is only returned if the query failed.
+func (p *P0fClient) QueryOS(ip net.IP) (string, error) {
+	f, err := p.Lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	return f.OS, nil
+}
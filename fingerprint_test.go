@@ -0,0 +1,116 @@
+package p0fclient
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResponseFingerprint(t *testing.T) {
+	resp := &Response{
+		Status:        P0F_STATUS_OK,
+		Distance:      12,
+		UptimeMinutes: 90,
+	}
+	copy(resp.OsName[:], "Linux")
+	copy(resp.OsFlavor[:], "3.11 and newer")
+	copy(resp.HttpName[:], "Firefox")
+	copy(resp.LinkType[:], "Ethernet or modem")
+
+	f := resp.Fingerprint()
+	if !f.Matched || f.OS != "Linux 3.11 and newer" || f.HTTP != "Firefox" || f.LinkType != "Ethernet or modem" {
+		t.Errorf("unexpected fingerprint: %+v", f)
+	}
+	if f.Distance == nil || *f.Distance != 12 {
+		t.Errorf("expected distance 12, got %v", f.Distance)
+	}
+	if f.Uptime == nil || *f.Uptime != 90*time.Minute {
+		t.Errorf("expected uptime 90m, got %v", f.Uptime)
+	}
+
+	resp.Distance = -1
+	resp.UptimeMinutes = 0
+	if f := resp.Fingerprint(); f.Distance != nil || f.Uptime != nil {
+		t.Errorf("expected unknown distance and uptime, got %+v", f)
+	}
+
+	resp.Status = P0F_STATUS_NOMATCH
+	if f := resp.Fingerprint(); f.Matched || f.OS != "" {
+		t.Errorf("expected empty fingerprint, got %+v", f)
+	}
+}
+
+func TestP0fLookup(t *testing.T) {
+	expected := okResponse
+	copy(expected.OsName[:], "Linux")
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, expected)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	f, err := pc.Lookup(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if !f.Matched || f.OS != "Linux" {
+		t.Errorf("unexpected fingerprint: %+v", f)
+	}
+
+	if _, err := pc.Lookup(nil); err == nil {
+		t.Errorf("expected error for invalid IP")
+	}
+}
+
+func TestP0fQueryOS(t *testing.T) {
+	match := okResponse
+	copy(match.OsName[:], "Windows")
+	copy(match.OsFlavor[:], "7 or 8")
+	noMatch := Response{Magic: P0F_RESPONSE_MAGIC, Status: P0F_STATUS_NOMATCH}
+
+	for _, test := range []struct {
+		description string
+		response    Response
+		expected    string
+	}{
+		{
+			description: "match",
+			response:    match,
+			expected:    "Windows 7 or 8",
+		},
+		{
+			description: "no match",
+			response:    noMatch,
+			expected:    "",
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			socket := startTestServer(t, func(conn net.Conn) {
+				answerQueries(conn, test.response)
+			})
+
+			pc := NewP0fClient(socket)
+			if err := pc.Connect(); err != nil {
+				t.Fatalf("could not connect: %s", err)
+			}
+			defer pc.Stop()
+
+			os, err := pc.QueryOS(net.ParseIP("127.0.0.1"))
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if os != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, os)
+			}
+		})
+	}
+
+	pc := NewP0fClient("/tmp/unused.sock")
+	if _, err := pc.QueryOS(net.ParseIP("127.0.0.1")); err == nil {
+		t.Errorf("expected an error without a connection")
+	}
+}
@@ -0,0 +1,22 @@
+package p0fclient
+
+import "time"
+
+// Observer is told about every query done by a client, for example to feed
+// Prometheus histograms and counters. Set it with SetObserver.
+type Observer interface {
+	// OnQuery is called after each query with the time the query took, the
+	// status p0f answered with and the error returned to the caller. The
+	// status is only meaningful when p0f answered; on a communication error
+	// it is zero. OnQuery is called while the client is locked so it must
+	// be fast and must not use the client.
+	OnQuery(duration time.Duration, status Status, err error)
+}
+
+// ObserverFunc adapts a function to the Observer interface.
+type ObserverFunc func(duration time.Duration, status Status, err error)
+
+// OnQuery calls f.
+func (f ObserverFunc) OnQuery(duration time.Duration, status Status, err error) {
+	f(duration, status, err)
+}
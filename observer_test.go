@@ -0,0 +1,85 @@
+package p0fclient
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestObserver(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	type call struct {
+		status Status
+		err    error
+	}
+	var calls []call
+
+	pc := NewP0fClient(socket)
+	pc.SetObserver(ObserverFunc(func(d time.Duration, status Status, err error) {
+		if d < 0 {
+			t.Errorf("expected a non-negative duration, got %s", d)
+		}
+		calls = append(calls, call{status: status, err: err})
+	}))
+
+	// Not connected yet, so this query fails.
+	pc.QueryIP(net.ParseIP("127.0.0.1"))
+
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	pc.QueryIP(net.ParseIP("127.0.0.1"))
+
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 calls, got %d", len(calls))
+	}
+
+	if !errors.Is(calls[0].err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected for the first call, got %v", calls[0].err)
+	}
+
+	if calls[1].err != nil || calls[1].status != P0F_STATUS_OK {
+		t.Errorf("expected a match for the second call, got %+v", calls[1])
+	}
+}
+
+func TestObserverPipelined(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	var statuses []Status
+	pc := NewP0fClient(socket)
+	pc.SetObserver(ObserverFunc(func(d time.Duration, status Status, err error) {
+		if err != nil {
+			t.Errorf("expected no error, got %s", err)
+		}
+		statuses = append(statuses, status)
+	}))
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	// The unspecified address is never sent so it is not reported.
+	pc.QueryIPsPipelined([]net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.IPv4zero,
+		net.ParseIP("192.0.2.2"),
+	})
+
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 calls, got %d", len(statuses))
+	}
+	for i, status := range statuses {
+		if status != P0F_STATUS_OK {
+			t.Errorf("call %d: expected status ok, got %s", i, status)
+		}
+	}
+}
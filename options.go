@@ -0,0 +1,103 @@
+package p0fclient
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Option configures a P0fClient when it is created with NewP0fClient or
+// NewP0fClientNet. Every option has a setter with the same effect that can be
+// used after the client was created.
+type Option func(*P0fClient)
+
+// WithTimeout sets the timeout of socket reads and writes; see SetTimeout.
+func WithTimeout(d time.Duration) Option {
+	return func(p *P0fClient) {
+		p.timeout = d
+	}
+}
+
+// WithAutoReconnect enables reconnecting after a communication error; see
+// SetAutoReconnect.
+func WithAutoReconnect(maxRetries int) Option {
+	return func(p *P0fClient) {
+		p.maxRetries = maxRetries
+	}
+}
+
+// WithObserver sets the observer that is told about every query; see
+// SetObserver.
+func WithObserver(o Observer) Option {
+	return func(p *P0fClient) {
+		p.observer = o
+	}
+}
+
+// WithMappedAsIPv6 controls how IPv4-mapped IPv6 addresses are queried; see
+// SetMappedAsIPv6.
+func WithMappedAsIPv6(enabled bool) Option {
+	return func(p *P0fClient) {
+		p.mappedAsIPv6 = enabled
+	}
+}
+
+// WithPerQueryConnection makes every query use its own connection; see
+// SetPerQueryConnection.
+func WithPerQueryConnection(enabled bool) Option {
+	return func(p *P0fClient) {
+		p.perQuery = enabled
+	}
+}
+
+// WithCheckTrailingData enables checking for data after a response; see
+// SetCheckTrailingData.
+func WithCheckTrailingData(enabled bool) Option {
+	return func(p *P0fClient) {
+		p.checkTrailing = enabled
+	}
+}
+
+// WithDialFunc sets the function used to open connections; see SetDialFunc.
+func WithDialFunc(dial DialFunc) Option {
+	return func(p *P0fClient) {
+		p.dialFunc = dial
+	}
+}
+
+// WithLogger sets the logger the client logs to; see SetLogger.
+func WithLogger(l *slog.Logger) Option {
+	return func(p *P0fClient) {
+		p.logger = l
+	}
+}
+
+// WithAllowUnspecified allows querying unspecified addresses; see
+// SetAllowUnspecified.
+func WithAllowUnspecified(enabled bool) Option {
+	return func(p *P0fClient) {
+		p.allowUnspecified = enabled
+	}
+}
+
+// WithBufferPool makes queries use a shared pool of response buffers; see
+// SetBufferPool.
+func WithBufferPool(enabled bool) Option {
+	return func(p *P0fClient) {
+		p.bufferPool = enabled
+	}
+}
+
+// WithCache enables caching up to size responses for ttl; see SetCache.
+func WithCache(size int, ttl time.Duration) Option {
+	return func(p *P0fClient) {
+		p.cache = newResponseCache(size, ttl)
+	}
+}
+
+// WithMagic sets the magic values of queries and responses; see SetMagic.
+func WithMagic(reqMagic, respMagic uint32) Option {
+	return func(p *P0fClient) {
+		p.requestMagic = reqMagic
+		p.responseMagic = respMagic
+	}
+}
@@ -0,0 +1,42 @@
+package p0fclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOptions(t *testing.T) {
+	observer := ObserverFunc(func(time.Duration, Status, error) {})
+
+	pc := NewP0fClient("/tmp/p0f.sock",
+		WithTimeout(time.Second),
+		WithAutoReconnect(3),
+		WithObserver(observer),
+		WithMappedAsIPv6(true),
+		WithPerQueryConnection(true),
+		WithCheckTrailingData(true),
+	)
+
+	if pc.network != "unix" || pc.socketFile != "/tmp/p0f.sock" {
+		t.Errorf("unexpected socket %s %s", pc.network, pc.socketFile)
+	}
+	if pc.timeout != time.Second {
+		t.Errorf("expected timeout 1s, got %s", pc.timeout)
+	}
+	if pc.maxRetries != 3 {
+		t.Errorf("expected 3 retries, got %d", pc.maxRetries)
+	}
+	if pc.observer == nil {
+		t.Errorf("expected observer to be set")
+	}
+	if !pc.mappedAsIPv6 || !pc.perQuery || !pc.checkTrailing {
+		t.Errorf("expected all flags to be set: %+v", pc)
+	}
+}
+
+func TestNoOptions(t *testing.T) {
+	pc := NewP0fClient("/tmp/p0f.sock")
+	if pc.timeout != 0 || pc.maxRetries != 0 || pc.observer != nil || pc.perQuery {
+		t.Errorf("expected the defaults, got %+v", pc)
+	}
+}
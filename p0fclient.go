@@ -2,18 +2,93 @@
 package p0fclient
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math/bits"
 	"net"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // ErrSocketCommunication can be returned by queries. This error is worth
 // catching and to try and re-establish the connection with the socket.
 var ErrSocketCommunication = fmt.Errorf("could not communicate with p0f socket")
 
+// ErrTimeout is returned when a query did not complete within the timeout
+// configured with SetTimeout. It wraps ErrSocketCommunication so callers that
+// reconnect on communication errors will also do so on a timeout. The
+// connection is closed on a timeout so a late answer is never mistaken for
+// the answer to a following query.
+var ErrTimeout = fmt.Errorf("p0f query timed out: %w", ErrSocketCommunication)
+
+// ErrConnectionClosed is returned when p0f closed or reset the connection
+// before the query was answered, for example because it limits the number of
+// queries per connection. A write that fails with a broken pipe and a
+// connection that was closed underneath the client are reported this way as
+// well. It wraps ErrSocketCommunication, but unlike other communication
+// errors auto reconnect retries it without a backoff.
+var ErrConnectionClosed = fmt.Errorf("connection closed by p0f: %w", ErrSocketCommunication)
+
+// ErrNotConnected is returned when querying a client that has no connection
+// to p0f, either because Connect was not called or because the connection
+// was closed.
+var ErrNotConnected = fmt.Errorf("client not connected: call Connect first")
+
+// ErrBadMagic is returned when the response does not start with the p0f
+// response magic.
+var ErrBadMagic = fmt.Errorf("got bad magic")
+
+// ErrBigEndian is returned when the response magic is P0F_RESPONSE_MAGIC, or
+// the one set with SetMagic, in big-endian byte order, which happens with a
+// p0f running on a big-endian host or a relay that swaps bytes. It wraps
+// ErrBadMagic.
+var ErrBigEndian = fmt.Errorf("%w: response appears big-endian; this client assumes little-endian", ErrBadMagic)
+
+// ErrTrailingData is returned when SetCheckTrailingData is enabled and more
+// bytes than a single response arrived. The connection is closed as it is
+// out of sync with p0f.
+var ErrTrailingData = fmt.Errorf("unexpected data after response: %w", ErrSocketCommunication)
+
+// ErrQueryCanceled is returned by a query that was aborted with
+// CancelOngoing.
+var ErrQueryCanceled = fmt.Errorf("query canceled")
+
+// ErrUnspecifiedIP is returned when querying the unspecified address 0.0.0.0
+// or ::, which usually means that the caller failed to fill in the address.
+// Such queries can be allowed with SetAllowUnspecified.
+var ErrUnspecifiedIP = fmt.Errorf("refusing to query the unspecified address")
+
+// ErrBadQuery is returned when p0f answered that the query was malformed.
+// The error message holds the query that was sent, decoded and as bytes.
+var ErrBadQuery = fmt.Errorf("performed a bad query")
+
+// ConnectError is returned by Connect when the socket could not be reached.
+type ConnectError struct {
+	// Network and Address are the network and address that were dialed.
+	Network string
+	Address string
+	// Err is the reason the connection failed.
+	Err error
+}
+
+func (e *ConnectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
 // The fields below are all well documented in the p0f README section 4.
 
 const (
@@ -28,15 +103,87 @@ const (
 	P0F_RESPONSE_MAGIC  = 0x50304602
 )
 
+// Status is the status of a p0f response. It is one of the P0F_STATUS_*
+// constants.
+type Status uint32
+
+// String returns "ok", "nomatch" or "badquery", or "unknown" for a status
+// that is not known to this client.
+func (s Status) String() string {
+	switch s {
+	case P0F_STATUS_OK:
+		return "ok"
+	case P0F_STATUS_NOMATCH:
+		return "nomatch"
+	case P0F_STATUS_BADQUERY:
+		return "badquery"
+	default:
+		return "unknown"
+	}
+}
+
+// QuerySize and ResponseSize are the sizes in bytes of a Query and a
+// Response on the wire.
+const (
+	QuerySize    = 21
+	ResponseSize = 232
+)
+
+// AddressType is the type of the address in a p0f query. It is one of the
+// P0F_ADDR_* constants.
+type AddressType uint8
+
+// String returns "ipv4" or "ipv6", or "unknown" for an address type that is
+// not known to this client.
+func (a AddressType) String() string {
+	switch a {
+	case P0F_ADDR_IPV4:
+		return "ipv4"
+	case P0F_ADDR_IPV6:
+		return "ipv6"
+	default:
+		return "unknown"
+	}
+}
+
 type Query struct {
 	Magic       uint32
-	AddressType uint8
+	AddressType AddressType
 	Address     [16]uint8
 }
 
+// String returns the address type and the address of the query, for example
+// "ipv4 address 192.0.2.1". A magic other than P0F_REQUEST_MAGIC is
+// mentioned as well, as p0f rejects such a query.
+func (q Query) String() string {
+	var s string
+	if ip := q.ip(); ip != nil {
+		s = fmt.Sprintf("%s address %s", q.AddressType, ip)
+	} else {
+		s = fmt.Sprintf("address % x with unknown address type %#x", q.Address, uint8(q.AddressType))
+	}
+
+	if q.Magic != P0F_REQUEST_MAGIC {
+		s += fmt.Sprintf(" and bad magic %#x", q.Magic)
+	}
+	return s
+}
+
+// ip returns the queried address, or nil if the address type is unknown.
+func (q Query) ip() net.IP {
+	switch q.AddressType {
+	case P0F_ADDR_IPV4:
+		return net.IP(q.Address[:net.IPv4len])
+	case P0F_ADDR_IPV6:
+		return net.IP(q.Address[:])
+	default:
+		return nil
+	}
+}
+
 type Response struct {
 	Magic         uint32
-	Status        uint32
+	Status        Status
 	FirstSeen     uint32
 	LastSeen      uint32
 	TotalCount    uint32
@@ -55,29 +202,96 @@ type Response struct {
 	Language      [32]uint8
 }
 
+// String returns the OS name and flavor followed by the match quality, for
+// example "Linux 3.x (fuzzy, generic)" or "Linux 3.x (exact)".
 func (r *Response) String() string {
-	ret := fmt.Sprintf("%s %s", r.OsName, r.OsFlavor)
-	if r.OsMatchQ == P0F_MATCH_FUZZY {
-		ret += " (fuzzy)"
-	} else {
-		ret += " (generic)"
-	}
-
-	return ret
+	quality := fmt.Sprintf("(%s)", strings.Join(matchFlags(r.OsMatchQ), ", "))
+	return joinNonEmpty(r.OsNameString(), r.OsFlavorString(), quality)
 }
 
+// DialFunc opens a connection to p0f, like net.Dial.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// P0fClient queries p0f over a single connection. It is safe for concurrent
+// use; queries are serialized.
 type P0fClient struct {
+	network    string
 	socketFile string
-	connection net.Conn
-	mu         sync.Mutex
+	dialFunc   DialFunc
+	// connection is guarded by mu. A query holds mu for its whole round
+	// trip, so the connection is never replaced, by Reconnect or auto
+	// reconnect, while it is in use.
+	connection io.ReadWriter
+	timeout    time.Duration
+	maxRetries int
+	observer   Observer
+	logger     *slog.Logger
+	// mappedAsIPv6 makes IPv4-mapped IPv6 addresses be queried as IPv6.
+	mappedAsIPv6 bool
+	// perQuery makes every query use its own connection.
+	perQuery bool
+	// allowUnspecified allows querying 0.0.0.0 and ::.
+	allowUnspecified bool
+	// bufferPool makes queries borrow their response buffer from
+	// responseBufferPool instead of using readbuf.
+	bufferPool bool
+	// cache holds recent responses if enabled with SetCache.
+	cache *responseCache
+	// stops counts the calls to Stop. A query that released mu to wait
+	// between retries gives up if it changed in the meantime.
+	stops uint64
+	// injected is set when the connection was passed to NewP0fClientConn.
+	// Connect then keeps it and no new connection can be dialed.
+	injected bool
+	// requestMagic and responseMagic override P0F_REQUEST_MAGIC and
+	// P0F_RESPONSE_MAGIC if not zero.
+	requestMagic  uint32
+	responseMagic uint32
+	// checkTrailing makes every query check that no data follows the
+	// response.
+	checkTrailing bool
+	// readDeadline and writeDeadline are set by the user with
+	// SetReadDeadline and SetWriteDeadline.
+	readDeadline  time.Time
+	writeDeadline time.Time
+	mu            sync.Mutex
+
+	// querybuf and readbuf are reused by all queries to save allocations.
+	// They are guarded by mu.
+	querybuf bytes.Buffer
+	readbuf  []byte
+	// lastRead is the number of response bytes read by the last round trip.
+	lastRead int
+
+	// inflight is the connection of the query in progress, if any. It is
+	// guarded by cancelMu instead of mu so that CancelOngoing can reach it
+	// while a query holds mu. canceled is set by CancelOngoing.
+	cancelMu sync.Mutex
+	inflight io.ReadWriter
+	canceled atomic.Bool
 }
 
-// NewP0fClient returns a new instance of P0fClient.
-// Remember to call Connect() before doing any queries.
+// pipelineReadAhead is the maximum number of responses QueryIPsPipelined
+// reads ahead.
+const pipelineReadAhead = 64
+
+// trailingDataWait is how long SetCheckTrailingData waits for unexpected
+// data after a response.
+const trailingDataWait = time.Millisecond
+
+// reconnectBackoff is the time waited before the first reconnect attempt.
+// It doubles with every following attempt up to maxReconnectBackoff.
+const (
+	reconnectBackoff    = 100 * time.Millisecond
+	maxReconnectBackoff = 5 * time.Second
+)
+
+// NewP0fClient returns a new instance of P0fClient, configured by the given
+// options. Remember to call Connect() before doing any queries.
 //
 // Typical usage looks like:
 //
-//		pc := NewP0fClient("/path/to/socket")
+//		pc := NewP0fClient("/path/to/socket", WithTimeout(time.Second))
 //	 if err := pc.Connect(); err != nil {
 //	   // handle error
 //	 }
@@ -85,36 +299,487 @@ type P0fClient struct {
 //	 parsedIP, _ := net.ParseIP("1.2.3.4")
 //	 res := pc.QueryIP(parsedIP)
 //	 fmt.Printf("OS: %s\n", res.OsName)
-func NewP0fClient(socketFile string) *P0fClient {
-	return &P0fClient{
-		socketFile: socketFile,
+func NewP0fClient(socketFile string, opts ...Option) *P0fClient {
+	return NewP0fClientNet("unix", socketFile, opts...)
+}
+
+// newP0fClientRW returns a client that reads and writes over rw instead of a
+// socket. It is connected right away; Connect must not be called on it.
+func newP0fClientRW(rw io.ReadWriter) *P0fClient {
+	return &P0fClient{connection: rw}
+}
+
+// NewP0fClientConn returns a client that queries p0f over conn, for callers
+// that manage the connection themselves, for example over a multiplexed
+// tunnel. The client is connected right away and Connect does nothing. Once
+// conn is closed, by Stop or because of an error, the client cannot
+// reconnect, so auto reconnect and per-query connections do not work. Stop
+// closes conn.
+func NewP0fClientConn(conn net.Conn, opts ...Option) *P0fClient {
+	p := &P0fClient{connection: conn, injected: true}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// NewP0fClientNet returns a new instance of P0fClient that connects to the
+// given address on the given network, as accepted by net.Dial. This allows
+// talking to p0f over for example a "tcp" relay, a "unixpacket" socket or an
+// abstract unix socket (an address starting with "@").
+func NewP0fClientNet(network, address string, opts ...Option) *P0fClient {
+	p := &P0fClient{
+		network:    network,
+		socketFile: address,
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
-// Set the socket
+// SetSocket sets the socket used by the next call to Connect. The current
+// connection, if any, is left alone; use Reconnect to switch the connection
+// to the new socket right away.
 func (p *P0fClient) SetSocket(socket string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.socketFile = socket
 }
 
-// Connect opens a connection to the p0f socket.
+// SetTimeout sets the maximum duration each write to and read from the
+// socket may take. A zero duration, the default, disables the timeout.
+func (p *P0fClient) SetTimeout(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeout = d
+}
+
+// SetAutoReconnect enables transparently re-establishing the connection when
+// a query fails with ErrSocketCommunication. The query is retried up to
+// maxRetries times, with an exponential backoff between the attempts. If all
+// attempts fail the error of the last attempt is returned. A maxRetries of 0,
+// the default, disables reconnecting.
+func (p *P0fClient) SetAutoReconnect(maxRetries int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxRetries = maxRetries
+}
+
+// SetMappedAsIPv6 controls how IPv4-mapped IPv6 addresses such as
+// ::ffff:192.0.2.1 are queried. p0f keeps IPv4 and IPv6 hosts apart so these
+// give different answers. By default they are queried as IPv4.
+//
+// When enabled they are queried as IPv6. Note that net.ParseIP returns a 16
+// byte IPv4-mapped address for plain IPv4 strings as well, so in this mode
+// only 4 byte IPs, such as the result of ip.To4(), are queried as IPv4.
+func (p *P0fClient) SetMappedAsIPv6(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mappedAsIPv6 = enabled
+}
+
+// SetPerQueryConnection makes every query open its own short-lived
+// connection to p0f, which is closed again once the query is done. Queries
+// then no longer wait for each other, at the cost of setting up a connection
+// for every query. This suits scanning tools that fire many concurrent
+// queries. Connect does nothing in this mode and a QueryIPs batch uses one
+// connection for the whole batch. When an observer is set it is called
+// concurrently in this mode.
+func (p *P0fClient) SetPerQueryConnection(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.perQuery = enabled
+}
+
+// perQueryClient returns a new client with the configuration of p if
+// per-query connections are enabled, or nil otherwise.
+func (p *P0fClient) perQueryClient() *P0fClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.perQuery {
+		return nil
+	}
+
+	return p.config()
+}
+
+// Clone returns a new client with the same configuration as p, such as the
+// socket, timeout and observer. The connection is not shared: the clone
+// starts out disconnected and must be connected with Connect.
+func (p *P0fClient) Clone() *P0fClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c := p.config()
+	c.perQuery = p.perQuery
+	return c
+}
+
+// config returns a new, disconnected client with the configuration of p,
+// except for per-query connections. Must be called with the mutex held.
+func (p *P0fClient) config() *P0fClient {
+	return &P0fClient{
+		network:          p.network,
+		socketFile:       p.socketFile,
+		dialFunc:         p.dialFunc,
+		timeout:          p.timeout,
+		maxRetries:       p.maxRetries,
+		observer:         p.observer,
+		logger:           p.logger,
+		mappedAsIPv6:     p.mappedAsIPv6,
+		checkTrailing:    p.checkTrailing,
+		allowUnspecified: p.allowUnspecified,
+		bufferPool:       p.bufferPool,
+		cache:            p.cache,
+		requestMagic:     p.requestMagic,
+		responseMagic:    p.responseMagic,
+		readDeadline:     p.readDeadline,
+		writeDeadline:    p.writeDeadline,
+	}
+}
+
+// SetReadDeadline sets the deadline for reading the responses of p0f, for
+// use by callers that manage deadlines themselves. Unlike the timeout of
+// SetTimeout it is an absolute time that applies to all following queries,
+// also after a reconnect, until it is changed. When a timeout or context
+// deadline is set as well the earliest deadline is used. A zero t clears the
+// deadline. The error of the current connection, if any, is returned.
+func (p *P0fClient) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.readDeadline = t
+	if conn, ok := p.connection.(readWriteDeadlineSetter); ok {
+		return conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// SetWriteDeadline is like SetReadDeadline but sets the deadline for
+// writing the queries.
+func (p *P0fClient) SetWriteDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.writeDeadline = t
+	if conn, ok := p.connection.(readWriteDeadlineSetter); ok {
+		return conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// SetCheckTrailingData enables checking that no more data is available on
+// the connection after a response was read. p0f sends exactly one response
+// per query, so extra data means that the connection is out of sync, for
+// example because of a misbehaving relay. The query then fails with
+// ErrTrailingData instead of the next query returning the wrong answer. The
+// check waits briefly for data, which adds about a millisecond to every
+// query, and only works for connections that support deadlines.
+func (p *P0fClient) SetCheckTrailingData(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.checkTrailing = enabled
+}
+
+// SetDialFunc sets the function used by Connect to open connections, for
+// example to reach p0f through an SSH tunnel or a proxy. The socket file is
+// then not checked for existence before dialing, and ConnectContext can only
+// give up before the dial starts. Pass nil to use net.Dial again.
+func (p *P0fClient) SetDialFunc(dial DialFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialFunc = dial
+}
+
+// SetLogger sets the logger that the client logs connection attempts and
+// queries to. Successful queries are logged at debug level and failures as
+// warnings, with the queried IP as the "ip" attribute. Pass nil, the
+// default, to disable logging.
+func (p *P0fClient) SetLogger(l *slog.Logger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.logger = l
+}
+
+// SetAllowUnspecified allows querying the unspecified addresses 0.0.0.0 and
+// ::, which are rejected with ErrUnspecifiedIP by default. Ping is not
+// affected by this setting.
+func (p *P0fClient) SetAllowUnspecified(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.allowUnspecified = enabled
+}
+
+// SetBufferPool makes queries borrow their response buffer from a pool that
+// is shared by all clients instead of keeping a buffer per client. This
+// saves memory and allocations when many clients exist, for example in a
+// P0fPool or with per-query connections, which would otherwise allocate a
+// buffer for every query.
+func (p *P0fClient) SetBufferPool(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bufferPool = enabled
+}
+
+// SetCache enables caching up to size responses by IP address for ttl, so
+// that QueryIP, QueryIPContext and QueryIPInto answer repeated queries for
+// an address without asking p0f. Responses are cached by the address type
+// and address that were sent, so an IPv4-mapped IPv6 address queried as IPv6
+// with SetMappedAsIPv6 does not get the answer for the IPv4 address. When
+// the cache is full the least recently used response is dropped. Responses
+// without a match are cached as well; failed queries are not. A size or ttl
+// that is not positive disables the cache. Enabling it again starts with an
+// empty cache.
+//
+// What p0f knows about a host changes as it sees more traffic, so keep the
+// ttl short, in the order of seconds. Answers from the cache are not reported
+// to the observer. The cache is shared with clones of the client.
+func (p *P0fClient) SetCache(size int, ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache = newResponseCache(size, ttl)
+}
+
+// SetMagic sets the magic values of queries and responses, for talking to
+// custom p0f builds that changed them. Responses are then checked against
+// respMagic instead of P0F_RESPONSE_MAGIC. A zero value restores the
+// standard P0F_REQUEST_MAGIC or P0F_RESPONSE_MAGIC. NewQuery, WriteQuery and
+// ReadResponse always use the standard values.
+func (p *P0fClient) SetMagic(reqMagic, respMagic uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requestMagic = reqMagic
+	p.responseMagic = respMagic
+}
+
+// magics returns the request and response magic of the client. Must be
+// called with the mutex held.
+func (p *P0fClient) magics() (uint32, uint32) {
+	req, resp := uint32(P0F_REQUEST_MAGIC), uint32(P0F_RESPONSE_MAGIC)
+	if p.requestMagic != 0 {
+		req = p.requestMagic
+	}
+	if p.responseMagic != 0 {
+		resp = p.responseMagic
+	}
+	return req, resp
+}
+
+// SetObserver sets the observer that is told about every query. Pass nil to
+// remove the observer.
+func (p *P0fClient) SetObserver(o Observer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.observer = o
+}
+
+// Connect opens a connection to the p0f socket. If the client is already
+// connected then the existing connection is closed first. Connect does
+// nothing when per-query connections are enabled or the client was created
+// with NewP0fClientConn, unless the connection of the latter was closed, in
+// which case a ConnectError is returned.
 func (p *P0fClient) Connect() error {
-	if _, err := os.Stat(p.socketFile); err != nil {
-		return fmt.Errorf("could not stat file: %w", err)
+	return p.ConnectContext(context.Background())
+}
+
+// ConnectContext is like Connect but gives up connecting when the context
+// is done, for example when the dial hangs because the listen backlog of p0f
+// is full. The existing connection, if any, is kept when the dial fails.
+func (p *P0fClient) ConnectContext(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.injected && p.connection == nil {
+		return &ConnectError{
+			Network: p.network,
+			Address: p.socketFile,
+			Err:     fmt.Errorf("the connection passed to NewP0fClientConn was closed"),
+		}
+	}
+	if p.perQuery || p.injected {
+		return nil
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	if p.connection != nil {
+		closeConn(p.connection)
+	}
+
+	p.connection = conn
+	return nil
+}
+
+// ConnectWithRetry calls Connect until it succeeds, which is useful when the
+// client may start before p0f has created its socket. Between attempts it
+// waits, starting with backoff and doubling up to 32 times backoff. It gives
+// up after maxAttempts attempts, or never if maxAttempts is 0 or less, and
+// when the context is done. The error of the last attempt is returned.
+func (p *P0fClient) ConnectWithRetry(ctx context.Context, backoff time.Duration, maxAttempts int) error {
+	for attempt := 0; ; attempt++ {
+		err := p.ConnectContext(ctx)
+		if err == nil {
+			return nil
+		}
+
+		if maxAttempts > 0 && attempt+1 >= maxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", maxAttempts, err)
+		}
+
+		if ctxErr := sleepContext(ctx, exponentialBackoff(backoff, 32*backoff, attempt)); ctxErr != nil {
+			return fmt.Errorf("%w: %w", ctxErr, err)
+		}
+	}
+}
+
+// Reconnect points the client at a different socket and connects to it. The
+// old connection is only closed once the new one is established; if the new
+// socket cannot be reached then the client keeps using the old socket and
+// connection.
+func (p *P0fClient) Reconnect(socket string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	oldSocket := p.socketFile
+	p.socketFile = socket
+	conn, err := p.dial(context.Background())
+	if err != nil {
+		p.socketFile = oldSocket
+		return err
+	}
+
+	if p.connection != nil {
+		closeConn(p.connection)
+	}
+
+	p.connection = conn
+	return nil
+}
+
+// dial opens a new connection to the socket and logs the attempt. Must be
+// called with the mutex held.
+func (p *P0fClient) dial(ctx context.Context) (net.Conn, error) {
+	if p.logger == nil {
+		return p.dialConn(ctx)
+	}
+
+	attrs := []slog.Attr{slog.String("network", p.network), slog.String("address", p.socketFile)}
+	p.logger.LogAttrs(ctx, slog.LevelDebug, "connecting to p0f", attrs...)
+
+	conn, err := p.dialConn(ctx)
+	if err != nil {
+		p.logger.LogAttrs(ctx, slog.LevelError, "could not connect to p0f", append(attrs, slog.Any("error", err))...)
+	}
+	return conn, err
+}
+
+// dialConn opens a new connection to the socket. Must be called with the
+// mutex held.
+func (p *P0fClient) dialConn(ctx context.Context) (net.Conn, error) {
+	if p.injected {
+		return nil, &ConnectError{
+			Network: p.network,
+			Address: p.socketFile,
+			Err:     fmt.Errorf("cannot dial a client created with NewP0fClientConn"),
+		}
+	}
+
+	if p.dialFunc != nil {
+		return p.dialCustom(ctx)
+	}
+
+	if isFilesystemSocket(p.network, p.socketFile) {
+		if _, err := os.Stat(p.socketFile); err != nil {
+			return nil, &ConnectError{
+				Network: p.network,
+				Address: p.socketFile,
+				Err:     fmt.Errorf("could not stat file: %w", err),
+			}
+		}
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, p.network, p.socketFile)
+	if err != nil {
+		return nil, &ConnectError{
+			Network: p.network,
+			Address: p.socketFile,
+			Err:     fmt.Errorf("could not open socket: %w", err),
+		}
+	}
+
+	return conn, nil
+}
+
+// dialCustom opens a new connection with the DialFunc set by the user.
+func (p *P0fClient) dialCustom(ctx context.Context) (net.Conn, error) {
+	var conn net.Conn
+	err := ctx.Err()
+	if err == nil {
+		conn, err = p.dialFunc(p.network, p.socketFile)
+	}
+	if err != nil {
+		return nil, &ConnectError{
+			Network: p.network,
+			Address: p.socketFile,
+			Err:     fmt.Errorf("could not open socket: %w", err),
+		}
+	}
+
+	return conn, nil
+}
+
+// isFilesystemSocket returns true if the address refers to a socket file on
+// the filesystem. Abstract unix sockets start with "@" or a NUL byte.
+func isFilesystemSocket(network, address string) bool {
+	switch network {
+	case "unix", "unixpacket":
+		return !strings.HasPrefix(address, "@") && !strings.HasPrefix(address, "\x00")
+	default:
+		return false
+	}
+}
+
+// reconnect replaces the current connection with a new one. Must be called
+// with the mutex held.
+func (p *P0fClient) reconnect(ctx context.Context) error {
+	p.invalidate()
+
+	if p.logger != nil {
+		p.logger.LogAttrs(ctx, slog.LevelInfo, "reconnecting to p0f")
 	}
 
-	conn, err := net.Dial("unix", p.socketFile)
+	conn, err := p.dial(ctx)
 	if err != nil {
-		return fmt.Errorf("could not open socket: %w", err)
+		return fmt.Errorf("reconnecting: %w: %w", err, ErrSocketCommunication)
 	}
 
 	p.connection = conn
 	return nil
 }
 
+// createQueryForIP creates the query for ip. IPv4-mapped IPv6 addresses are
+// queried as IPv4.
 func createQueryForIP(ip net.IP) (Query, error) {
+	return createQuery(ip, false)
+}
+
+// createQuery creates the query for ip. If mappedAsIPv6 is set then an
+// IPv4-mapped IPv6 address is queried as IPv6; only a 4 byte net.IP is then
+// queried as IPv4.
+func createQuery(ip net.IP, mappedAsIPv6 bool) (Query, error) {
 	query := Query{Magic: P0F_REQUEST_MAGIC}
 
 	ipBytes := ip.To4()
+	if mappedAsIPv6 && len(ip) == net.IPv6len {
+		ipBytes = nil
+	}
+
 	if ipBytes == nil {
 		ipBytes = ip.To16()
 		query.AddressType = P0F_ADDR_IPV6
@@ -123,16 +788,19 @@ func createQueryForIP(ip net.IP) (Query, error) {
 	}
 
 	if ipBytes == nil {
-		// This probably will never happen. Famous last words..
-		return query, fmt.Errorf("could not convert IP to bytes")
+		return query, fmt.Errorf("could not convert IP to bytes: invalid length %d", len(ip))
 	}
 
-	idx := 0
-	for _, b := range ipBytes {
-		query.Address[idx] = b
-		idx += 1
+	// Make sure the address and the address type agree so a malformed
+	// net.IP can never result in a corrupt query.
+	switch {
+	case len(ipBytes) == net.IPv4len && query.AddressType == P0F_ADDR_IPV4:
+	case len(ipBytes) == net.IPv6len && query.AddressType == P0F_ADDR_IPV6:
+	default:
+		return query, fmt.Errorf("address of %d bytes does not match address type %d", len(ipBytes), query.AddressType)
 	}
 
+	copy(query.Address[:], ipBytes)
 	return query, nil
 }
 
@@ -144,58 +812,1156 @@ func createQueryForIP(ip net.IP) (Query, error) {
 // with the p0f socket went successfully. It is up to the called to still
 // check resp.Status to check if their was a fingerprint match.
 func (p *P0fClient) QueryIP(ip net.IP) (*Response, error) {
-	resp := &Response{}
+	return p.QueryIPContext(context.Background(), ip)
+}
 
-	query, err := createQueryForIP(ip)
-	if err != nil {
-		return nil, fmt.Errorf("could not create query: %w", err)
+// QueryString is like QueryIP but takes the IP address as a string.
+func (p *P0fClient) QueryString(ip string) (*Response, error) {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return nil, fmt.Errorf("invalid IP address: %q", ip)
 	}
 
-	var querybuf bytes.Buffer
-	if err = binary.Write(&querybuf, binary.LittleEndian, query); err != nil {
-		return nil, fmt.Errorf("could not write query to binary: %w", err)
+	return p.QueryIP(parsedIP)
+}
+
+// QueryAddr is like QueryIP but takes the IP address from addr, for example
+// the RemoteAddr of an accepted connection. addr must be a *net.TCPAddr,
+// *net.UDPAddr or *net.IPAddr; other address types return an error.
+func (p *P0fClient) QueryAddr(addr net.Addr) (*Response, error) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			ip = a.IP
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			ip = a.IP
+		}
+	case *net.IPAddr:
+		if a != nil {
+			ip = a.IP
+		}
 	}
 
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	if ip == nil {
+		return nil, fmt.Errorf("address %v of type %T has no IP address", addr, addr)
+	}
 
-	_, err = p.connection.Write(querybuf.Bytes())
+	return p.QueryIP(ip)
+}
+
+// QueryHost resolves host with net.DefaultResolver and queries p0f for
+// every address it resolves to. The context applies to the resolution and
+// the queries. The responses are in the order of the resolved addresses; the
+// response of an address whose query failed is nil and its error, prefixed
+// with the address, is part of the returned error. If the host cannot be
+// resolved then no responses are returned.
+func (p *P0fClient) QueryHost(ctx context.Context, host string) ([]*Response, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
 	if err != nil {
-		return nil, fmt.Errorf("writing to socket: %w", ErrSocketCommunication)
+		return nil, fmt.Errorf("could not resolve %s: %w", host, err)
 	}
 
-	var n int
-	readbuf := make([]byte, binary.Size(resp))
-	n, err = p.connection.Read(readbuf[:])
-	if err != nil {
-		return nil, fmt.Errorf("reading from socket: %w", ErrSocketCommunication)
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
 	}
 
-	buf := bytes.NewReader(readbuf[0:n])
-	err = binary.Read(buf, binary.LittleEndian, resp)
-	if err != nil {
-		return nil, fmt.Errorf("could not convert response: %w", err)
+	responses, errs := p.QueryIPsContext(ctx, ips)
+	for i, err := range errs {
+		if err != nil {
+			errs[i] = fmt.Errorf("%s: %w", ips[i], err)
+		}
 	}
+	return responses, errors.Join(errs...)
+}
 
-	// First check if the magic actually makes sense.
-	if resp.Magic != P0F_RESPONSE_MAGIC {
-		return nil, fmt.Errorf("got bad magic: %x", resp.Magic)
+// QueryMap queries p0f for every distinct address of ips and returns the
+// responses keyed by ip.String(), which is handy for joining them back into
+// data keyed by address. Addresses that occur more than once are queried
+// once; nil and malformed addresses are skipped. An address whose query
+// failed is left out of the map and its error, prefixed with the address, is
+// part of the returned error.
+func (p *P0fClient) QueryMap(ips []net.IP) (map[string]*Response, error) {
+	var unique []net.IP
+	seen := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		if ip.To16() == nil {
+			continue
+		}
+		if key := ip.String(); !seen[key] {
+			seen[key] = true
+			unique = append(unique, ip)
+		}
 	}
 
-	switch resp.Status {
-	case P0F_STATUS_OK:
-		return resp, nil
-	case P0F_STATUS_NOMATCH:
-		return resp, nil
-	case P0F_STATUS_BADQUERY:
-		return nil, fmt.Errorf("performed a bad query!: %w", err)
-	default:
-		return nil, fmt.Errorf("got unknown response status: %x", resp.Status)
+	responses, errs := p.QueryIPs(unique)
+	results := make(map[string]*Response, len(unique))
+	for i, ip := range unique {
+		if errs[i] != nil {
+			errs[i] = fmt.Errorf("%s: %w", ip, errs[i])
+			continue
+		}
+		results[ip.String()] = responses[i]
 	}
+	return results, errors.Join(errs...)
 }
 
-func (p *P0fClient) Stop() error {
+// QueryIPv4 is like QueryIP but returns an error if ip is not an IPv4
+// address. The address is always queried as IPv4, also if SetMappedAsIPv6
+// is enabled.
+func (p *P0fClient) QueryIPv4(ip net.IP) (*Response, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("not an IPv4 address: %s", ip)
+	}
+
+	return p.QueryIP(ip4)
+}
+
+// QueryIPv6 is like QueryIP but returns an error if ip would not be queried
+// as IPv6. By default IPv4 addresses, including IPv4-mapped IPv6 addresses
+// such as ::ffff:192.0.2.1, are rejected as QueryIP queries them as IPv4.
+// With SetMappedAsIPv6 enabled the 16 byte IPv4-mapped addresses are
+// accepted and queried as IPv6. Note that net.ParseIP returns the same
+// value for "192.0.2.1" and "::ffff:192.0.2.1".
+func (p *P0fClient) QueryIPv6(ip net.IP) (*Response, error) {
 	p.mu.Lock()
-	defer p.mu.Unlock()
-	return p.connection.Close()
+	mappedAsIPv6 := p.mappedAsIPv6
+	p.mu.Unlock()
+
+	mapped := mappedAsIPv6 && len(ip) == net.IPv6len
+	if (ip.To4() != nil && !mapped) || ip.To16() == nil {
+		return nil, fmt.Errorf("not an IPv6 address: %s", ip)
+	}
+
+	return p.QueryIP(ip)
+}
+
+// QueryIPContext is like QueryIP but honors the given context. The deadline
+// of the context, if any, is applied to the socket and a cancellation of the
+// context aborts a pending read or write. If the context is already done
+// before the query is sent then ctx.Err() is returned and the socket is not
+// touched. If the context ends while the query is in flight then the
+// connection is closed, as the late answer of p0f would otherwise be read by
+// the next query, and Connect has to be called again.
+func (p *P0fClient) QueryIPContext(ctx context.Context, ip net.IP) (*Response, error) {
+	resp := &Response{}
+	if err := p.queryIPInto(ctx, ip, resp, queryOptions{cached: true}); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// QueryIPInto is like QueryIP but decodes the answer into resp instead of
+// allocating a new Response, so that tight loops can reuse a single
+// Response. The contents of resp are undefined when an error is returned.
+// resp is owned by the caller; it must not be used by concurrent queries.
+func (p *P0fClient) QueryIPInto(ip net.IP, resp *Response) error {
+	return p.queryIPInto(context.Background(), ip, resp, queryOptions{cached: true})
+}
+
+// QueryIPTimed is like QueryIP but also returns how long the query took,
+// measured around writing the query and reading the answer. Waiting for
+// other queries of the client to finish before the query is sent is not
+// included. With auto reconnect the duration covers all attempts, including
+// the backoff between them, the reconnects and waiting for other queries
+// while the client was unlocked during the backoff. The duration is returned
+// even if the query failed. The query always goes to p0f, also when a cache
+// is set with SetCache.
+func (p *P0fClient) QueryIPTimed(ip net.IP) (*Response, time.Duration, error) {
+	var d time.Duration
+	resp := &Response{}
+	if err := p.queryIPInto(context.Background(), ip, resp, queryOptions{duration: &d}); err != nil {
+		return nil, d, err
+	}
+
+	return resp, d, nil
+}
+
+// queryOptions modify a single query done by queryIPInto.
+type queryOptions struct {
+	// allowUnspecified allows querying an unspecified address even if the
+	// client does not allow it.
+	allowUnspecified bool
+	// duration, if set, receives the time the query took, including any
+	// retries.
+	duration *time.Duration
+	// cached allows answering the query from the cache set with SetCache.
+	cached bool
+	// sent, if set, receives the query that was encoded for the address. It
+	// is left alone if no query could be created.
+	sent *Query
+}
+
+// queryIPInto queries the IP address and decodes the answer into resp.
+func (p *P0fClient) queryIPInto(ctx context.Context, ip net.IP, resp *Response, opts queryOptions) error {
+	if c := p.perQueryClient(); c != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.ConnectContext(ctx); err != nil {
+			return err
+		}
+		defer c.Stop()
+		return c.queryIPInto(ctx, ip, resp, opts)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.querybuf.Reset()
+	query, err := p.encodeQuery(ip, opts.allowUnspecified)
+	if err != nil {
+		return err
+	}
+	if opts.sent != nil {
+		*opts.sent = query
+	}
+
+	// The cache is keyed by the encoded query so that the configuration,
+	// such as SetMappedAsIPv6, is taken into account.
+	cache := p.cache
+	if !opts.cached {
+		cache = nil
+	}
+	if cache != nil && cache.get(query, resp) {
+		return nil
+	}
+
+	readbuf := p.responseBuffer()
+	defer p.releaseResponseBuffer(readbuf)
+
+	start := time.Now()
+	err = p.query(ctx, p.querybuf.Bytes(), readbuf, resp)
+	if opts.duration != nil {
+		*opts.duration = time.Since(start)
+	}
+	if err == nil && cache != nil {
+		cache.put(query, resp)
+	}
+	return err
+}
+
+// responseBufferPool holds response buffers that are shared by all clients
+// that use SetBufferPool.
+var responseBufferPool = sync.Pool{
+	New: func() any {
+		return new([ResponseSize]byte)
+	},
+}
+
+// responseBuffer returns the buffer to read responses into. It is taken from
+// responseBufferPool if enabled, in which case it must be given back with
+// releaseResponseBuffer. Must be called with the mutex held.
+func (p *P0fClient) responseBuffer() []byte {
+	if p.bufferPool {
+		return responseBufferPool.Get().(*[ResponseSize]byte)[:]
+	}
+
+	if p.readbuf == nil {
+		p.readbuf = make([]byte, ResponseSize)
+	}
+	return p.readbuf
+}
+
+// releaseResponseBuffer gives a buffer returned by responseBuffer back to
+// responseBufferPool, unless it is the buffer of the client itself. Must be
+// called with the mutex held.
+func (p *P0fClient) releaseResponseBuffer(buf []byte) {
+	if p.readbuf != nil && &buf[0] == &p.readbuf[0] {
+		return
+	}
+	responseBufferPool.Put((*[ResponseSize]byte)(buf))
+}
+
+// pingAddress is the address queried by Ping. p0f will never have seen it.
+var pingAddress = net.IPv4zero
+
+// Ping checks that p0f answers queries on the connection. It queries an
+// address p0f will not know about; both a match and no match count as
+// healthy so an error is only returned if p0f could not be queried.
+func (p *P0fClient) Ping() error {
+	if err := p.queryIPInto(context.Background(), pingAddress, &Response{}, queryOptions{allowUnspecified: true}); err != nil {
+		return fmt.Errorf("ping: %w", err)
+	}
+
+	return nil
+}
+
+// BuildQueryBytes returns the bytes QueryIP would write to the socket for
+// the IP address, without sending them. It applies the configuration of the
+// client, such as SetMappedAsIPv6, and fails like QueryIP for addresses that
+// cannot be queried. This helps comparing the query with the p0f protocol
+// when diagnosing problems.
+func (p *P0fClient) BuildQueryBytes(ip net.IP) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ip.IsUnspecified() && !p.allowUnspecified {
+		return nil, fmt.Errorf("%w: %s", ErrUnspecifiedIP, ip)
+	}
+
+	var buf bytes.Buffer
+	reqMagic, _ := p.magics()
+	if _, err := encodeQuery(&buf, ip, p.mappedAsIPv6, reqMagic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// QueryIPRaw is like QueryIP but also returns the bytes p0f sent, to help
+// diagnosing endianness or protocol version problems. The bytes are returned
+// even if the response could not be decoded; when the response was cut short
+// only the bytes that arrived are returned.
+func (p *P0fClient) QueryIPRaw(ip net.IP) (*Response, []byte, error) {
+	if c := p.perQueryClient(); c != nil {
+		if err := c.Connect(); err != nil {
+			return nil, nil, err
+		}
+		defer c.Stop()
+		return c.QueryIPRaw(ip)
+	}
+
+	resp := &Response{}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.querybuf.Reset()
+	if _, err := p.encodeQuery(ip, false); err != nil {
+		return nil, nil, err
+	}
+
+	readbuf := p.responseBuffer()
+	defer p.releaseResponseBuffer(readbuf)
+	p.lastRead = 0
+	err := p.query(context.Background(), p.querybuf.Bytes(), readbuf, resp)
+
+	var raw []byte
+	if p.lastRead > 0 {
+		raw = bytes.Clone(readbuf[:p.lastRead])
+	}
+
+	if err != nil {
+		return nil, raw, err
+	}
+
+	return resp, raw, nil
+}
+
+// QueryIPs queries p0f for all given IP addresses, one after the other, over
+// the single connection of the client. The lock and buffers are shared by all
+// queries, which makes this cheaper than calling QueryIP in a loop. Note that
+// p0f itself handles the queries of a connection serially so this does not
+// make the individual queries any faster.
+//
+// The returned slices have the same length as ips. For every IP either the
+// response or the error at the same index is set. A failing query does not
+// abort the batch. QueryIPResults returns the same as a slice of QueryResult.
+func (p *P0fClient) QueryIPs(ips []net.IP) ([]*Response, []error) {
+	return p.QueryIPsContext(context.Background(), ips)
+}
+
+// QueryIPsContext is like QueryIPs but the whole batch honors the given
+// context. Once the context is done no more queries are sent; the error of
+// the remaining addresses is set to ctx.Err() while the responses gathered so
+// far are kept.
+func (p *P0fClient) QueryIPsContext(ctx context.Context, ips []net.IP) ([]*Response, []error) {
+	return p.queryIPs(ctx, ips, nil)
+}
+
+// queryIPs implements QueryIPsContext. If sent is not nil the address type of
+// every query that was sent is stored in it at the index of the address.
+func (p *P0fClient) queryIPs(ctx context.Context, ips []net.IP, sent []AddressType) ([]*Response, []error) {
+	if c := p.perQueryClient(); c != nil {
+		if err := c.ConnectContext(ctx); err != nil {
+			errs := make([]error, len(ips))
+			for i := range errs {
+				errs[i] = err
+			}
+			return make([]*Response, len(ips)), errs
+		}
+		defer c.Stop()
+		return c.queryIPs(ctx, ips, sent)
+	}
+
+	responses := make([]*Response, len(ips))
+	errs := make([]error, len(ips))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	readbuf := p.responseBuffer()
+	defer p.releaseResponseBuffer(readbuf)
+	for i, ip := range ips {
+		if err := ctx.Err(); err != nil {
+			for j := i; j < len(ips); j++ {
+				errs[j] = err
+			}
+			break
+		}
+
+		p.querybuf.Reset()
+		query, err := p.encodeQuery(ip, false)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if sent != nil {
+			sent[i] = query.AddressType
+		}
+
+		resp := &Response{}
+		if err := p.query(ctx, p.querybuf.Bytes(), readbuf, resp); err != nil {
+			errs[i] = err
+			continue
+		}
+		responses[i] = resp
+	}
+
+	return responses, errs
+}
+
+// QueryIPsPipelined is like QueryIPs but it writes all queries to the socket
+// before reading the responses. p0f answers the queries of a connection in
+// the order they were received, so this saves a round trip per query while
+// the responses still line up with ips. The results are returned in the same
+// way as QueryIPs.
+//
+// The queries are written while the responses are read. Still, if p0f stops
+// reading because its own send buffer is full and the kernel buffers are
+// smaller than the batch, both sides wait for each other until the timeout
+// expires. Without a timeout this blocks forever, so set one with SetTimeout
+// or keep the batches small. Auto reconnect is not used for pipelined
+// queries; after any I/O error the connection is closed and the remaining
+// addresses get that error.
+//
+// Every query that is sent is reported to the observer and the logger. As
+// the queries overlap, the duration is the time from the start of the batch
+// until the response of the query was read.
+func (p *P0fClient) QueryIPsPipelined(ips []net.IP) ([]*Response, []error) {
+	if c := p.perQueryClient(); c != nil {
+		if err := c.Connect(); err != nil {
+			errs := make([]error, len(ips))
+			for i := range errs {
+				errs[i] = err
+			}
+			return make([]*Response, len(ips)), errs
+		}
+		defer c.Stop()
+		return c.QueryIPsPipelined(ips)
+	}
+
+	ctx := context.Background()
+	responses := make([]*Response, len(ips))
+	errs := make([]error, len(ips))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conn := p.connection
+	if conn == nil {
+		for i := range errs {
+			errs[i] = ErrNotConnected
+		}
+		return responses, errs
+	}
+
+	// Invalid addresses are never sent, sent holds the index of every query
+	// that is.
+	p.querybuf.Reset()
+	sent := make([]int, 0, len(ips))
+	for i, ip := range ips {
+		if _, err := p.encodeQuery(ip, false); err != nil {
+			errs[i] = err
+			continue
+		}
+		sent = append(sent, i)
+	}
+	if len(sent) == 0 {
+		return responses, errs
+	}
+
+	// query returns the encoded query of the n-th sent address.
+	start := time.Now()
+	query := func(n int) []byte {
+		return p.querybuf.Bytes()[n*QuerySize : (n+1)*QuerySize]
+	}
+
+	defer p.beginInflight(conn)()
+	if err := p.setDeadline(ctx, conn); err != nil {
+		for n, i := range sent {
+			errs[i] = err
+			p.reportQuery(ctx, query(n), time.Since(start), 0, err)
+		}
+		return responses, errs
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		err := writeFull(conn, p.querybuf.Bytes())
+		if err != nil {
+			err = p.ioError(ctx, "writing to socket", err)
+		}
+		written <- err
+	}()
+
+	// The responses are read through a buffer, which takes a single read
+	// for many responses instead of two reads for every response. Only
+	// responses to this batch arrive, so nothing is left in the buffer at
+	// the end.
+	br := bufio.NewReaderSize(conn, min(len(sent), pipelineReadAhead)*ResponseSize)
+	readbuf := p.responseBuffer()
+	defer p.releaseResponseBuffer(readbuf)
+	for n, i := range sent {
+		err := p.setDeadline(ctx, conn)
+		if err == nil {
+			err = p.receive(ctx, br, readbuf)
+		}
+		if err != nil {
+			// Closing the connection also unblocks the writer.
+			p.invalidate()
+			if werr := <-written; werr != nil {
+				err = werr
+			}
+			for m, j := range sent[n:] {
+				errs[j] = err
+				p.reportQuery(ctx, query(n+m), time.Since(start), 0, err)
+			}
+			return responses, errs
+		}
+
+		resp := &Response{}
+		err = decodeResponse(query(n), readbuf, resp)
+		p.reportQuery(ctx, query(n), time.Since(start), resp.Status, err)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		responses[i] = resp
+	}
+
+	<-written
+	setConnDeadline(conn, time.Time{})
+	return responses, errs
+}
+
+// encodeQuery appends the on-wire query for the IP address to querybuf and
+// returns it. It rejects unspecified addresses unless allowUnspecified is set
+// or they are allowed on the client. Must be called with the mutex held.
+func (p *P0fClient) encodeQuery(ip net.IP, allowUnspecified bool) (Query, error) {
+	if ip.IsUnspecified() && !allowUnspecified && !p.allowUnspecified {
+		return Query{}, fmt.Errorf("%w: %s", ErrUnspecifiedIP, ip)
+	}
+	reqMagic, _ := p.magics()
+	return encodeQuery(&p.querybuf, ip, p.mappedAsIPv6, reqMagic)
+}
+
+// encodeQuery writes the on-wire query for the IP address with the given
+// magic to buf and returns it. See createQuery for mappedAsIPv6.
+func encodeQuery(buf *bytes.Buffer, ip net.IP, mappedAsIPv6 bool, magic uint32) (Query, error) {
+	query, err := createQuery(ip, mappedAsIPv6)
+	if err != nil {
+		return Query{}, fmt.Errorf("could not create query: %w", err)
+	}
+	query.Magic = magic
+
+	if err = binary.Write(buf, binary.LittleEndian, query); err != nil {
+		return Query{}, fmt.Errorf("could not write query to binary: %w", err)
+	}
+
+	return query, nil
+}
+
+// query performs the query and reports it to the observer and the logger,
+// if any. Must be called with the mutex held.
+func (p *P0fClient) query(ctx context.Context, query []byte, readbuf []byte, resp *Response) error {
+	if p.observer == nil && p.logger == nil {
+		return p.queryWithRetry(ctx, query, readbuf, resp)
+	}
+
+	start := time.Now()
+	err := p.queryWithRetry(ctx, query, readbuf, resp)
+	p.reportQuery(ctx, query, time.Since(start), resp.Status, err)
+	return err
+}
+
+// reportQuery reports a finished query to the observer and the logger, if
+// any. Must be called with the mutex held.
+func (p *P0fClient) reportQuery(ctx context.Context, query []byte, duration time.Duration, status Status, err error) {
+	if p.observer != nil {
+		p.observer.OnQuery(duration, status, err)
+	}
+	if p.logger != nil {
+		p.logQuery(ctx, query, duration, status, err)
+	}
+}
+
+// logQuery logs a finished query: failures as a warning, other queries at
+// debug level.
+func (p *P0fClient) logQuery(ctx context.Context, query []byte, duration time.Duration, status Status, err error) {
+	attrs := []slog.Attr{slog.Duration("duration", duration)}
+	if q, qerr := decodeQuery(query); qerr == nil {
+		attrs = append(attrs, slog.Any("ip", q.ip()))
+	}
+
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+		p.logger.LogAttrs(ctx, slog.LevelWarn, "p0f query failed", attrs...)
+		return
+	}
+
+	attrs = append(attrs, slog.String("status", status.String()))
+	p.logger.LogAttrs(ctx, slog.LevelDebug, "p0f query", attrs...)
+}
+
+// queryWithRetry performs the query, reconnecting and retrying if auto
+// reconnect is enabled. Must be called with the mutex held. The mutex is
+// released while waiting between attempts so other callers are not blocked by
+// the backoff. If the client is stopped meanwhile ErrNotConnected is returned
+// instead of reconnecting.
+func (p *P0fClient) queryWithRetry(ctx context.Context, query []byte, readbuf []byte, resp *Response) error {
+	if p.connection == nil {
+		return ErrNotConnected
+	}
+	stops := p.stops
+
+	err := p.roundTrip(ctx, query, readbuf, resp)
+	if p.maxRetries > 0 && errors.Is(err, ErrSocketCommunication) {
+		// Other callers reuse the shared buffers while the mutex is
+		// released below, so retry with private copies. The response is
+		// copied back once the mutex is held for good.
+		orig := readbuf
+		defer func() { copy(orig, readbuf) }()
+		query = bytes.Clone(query)
+		readbuf = make([]byte, len(readbuf))
+	}
+
+	for attempt := 0; attempt < p.maxRetries && errors.Is(err, ErrSocketCommunication); attempt++ {
+		wait := backoff(attempt)
+		if errors.Is(err, ErrConnectionClosed) {
+			// A clean close is no fault that needs time to recover.
+			wait = 0
+		}
+
+		p.mu.Unlock()
+		sleepErr := sleepContext(ctx, wait)
+		p.mu.Lock()
+		if sleepErr != nil {
+			return sleepErr
+		}
+		if p.stops != stops {
+			return ErrNotConnected
+		}
+
+		// The failed attempt dropped the connection, unless another caller
+		// reconnected in the meantime.
+		if p.connection == nil {
+			if err = p.reconnect(ctx); err != nil {
+				p.lastRead = 0
+				continue
+			}
+		}
+		err = p.roundTrip(ctx, query, readbuf, resp)
+	}
+
+	return err
+}
+
+// roundTrip writes the query to the socket and decodes the answer into resp.
+// Must be called with the mutex held.
+func (p *P0fClient) roundTrip(ctx context.Context, query []byte, readbuf []byte, resp *Response) error {
+	conn := p.connection
+	p.lastRead = 0
+
+	stop := watchContext(ctx, conn)
+	defer stop()
+	defer p.beginInflight(conn)()
+
+	if err := p.setDeadline(ctx, conn); err != nil {
+		return err
+	}
+
+	if err := p.exchange(ctx, conn, query, readbuf); err != nil {
+		// The answer of p0f may still arrive on this connection and would
+		// then be read as the answer to the next query. The connection can
+		// therefore not be used anymore.
+		p.invalidate()
+		return err
+	}
+
+	return decodeResponse(query, readbuf, resp)
+}
+
+// decodeResponse decodes the raw response in readbuf into resp and converts
+// its status into an error. The query that was answered is only used to
+// describe a bad query.
+func decodeResponse(query []byte, readbuf []byte, resp *Response) error {
+	buf := bytes.NewReader(readbuf)
+	err := binary.Read(buf, binary.LittleEndian, resp)
+	if err != nil {
+		return fmt.Errorf("could not convert response: %w", err)
+	}
+
+	switch resp.Status {
+	case P0F_STATUS_OK:
+		return validateMatch(resp)
+	case P0F_STATUS_NOMATCH:
+		return nil
+	case P0F_STATUS_BADQUERY:
+		return badQueryError(query)
+	default:
+		return fmt.Errorf("got unknown response status: %x", uint32(resp.Status))
+	}
+}
+
+// badQueryError returns the error for a query that p0f rejected as
+// malformed. Besides the decoded query it holds the address type byte and
+// the raw bytes that were sent, as p0f does not tell what it rejected.
+func badQueryError(query []byte) error {
+	addressType := "missing"
+	if len(query) > 4 {
+		addressType = fmt.Sprintf("%#02x", query[4])
+	}
+	return fmt.Errorf("%w: sent %s (address type byte %s, query bytes % x)", ErrBadQuery, describeQuery(query), addressType, query)
+}
+
+// describeQuery returns the address type and address of an encoded query
+// for use in error messages.
+func describeQuery(query []byte) string {
+	q, err := decodeQuery(query)
+	if err != nil {
+		return fmt.Sprintf("undecodable query % x", query)
+	}
+	return q.String()
+}
+
+// decodeQuery decodes an encoded query.
+func decodeQuery(query []byte) (Query, error) {
+	var q Query
+	err := binary.Read(bytes.NewReader(query), binary.LittleEndian, &q)
+	return q, err
+}
+
+// validateMatch checks that the fields of a matching response hold values
+// this client knows about. Unknown values most likely mean that p0f uses a
+// newer version of the protocol.
+func validateMatch(resp *Response) error {
+	if resp.OsMatchQ&^(P0F_MATCH_FUZZY|P0F_MATCH_GENERIC) != 0 {
+		return fmt.Errorf("got unknown OS match quality: %x, possible p0f protocol mismatch", resp.OsMatchQ)
+	}
+
+	return nil
+}
+
+// exchange writes the query to conn and reads the full response into
+// readbuf. Must be called with the mutex held.
+func (p *P0fClient) exchange(ctx context.Context, conn io.ReadWriter, query []byte, readbuf []byte) error {
+	if err := writeFull(conn, query); err != nil {
+		return p.ioError(ctx, "writing to socket", err)
+	}
+
+	if err := p.setDeadline(ctx, conn); err != nil {
+		return err
+	}
+
+	if err := p.receive(ctx, conn, readbuf); err != nil {
+		return err
+	}
+
+	if p.checkTrailing {
+		return checkTrailingData(conn)
+	}
+	return nil
+}
+
+// checkTrailingData returns ErrTrailingData if more data can be read from
+// conn within trailingDataWait. The data that is read is lost, which does
+// not matter as the connection cannot be used anymore in that case.
+func checkTrailingData(conn io.ReadWriter) error {
+	if _, ok := conn.(deadlineSetter); !ok {
+		return nil
+	}
+
+	setConnDeadline(conn, time.Now().Add(trailingDataWait))
+	var b [1]byte
+	if n, _ := conn.Read(b[:]); n > 0 {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+// receive reads a single full response from conn into readbuf. Must be
+// called with the mutex held.
+func (p *P0fClient) receive(ctx context.Context, conn io.Reader, readbuf []byte) error {
+	// Read the magic first so that a response of another protocol version
+	// is reported as such instead of being misparsed.
+	magic := readbuf[:4]
+	if err := p.readResponse(ctx, conn, magic, 0, len(readbuf)); err != nil {
+		return err
+	}
+
+	_, expected := p.magics()
+	if m := binary.LittleEndian.Uint32(magic); m != expected {
+		if isBigEndianMagic(m, expected) {
+			return ErrBigEndian
+		}
+		return fmt.Errorf("%w: unexpected response magic % x, possible p0f version mismatch", ErrBadMagic, magic)
+	}
+
+	return p.readResponse(ctx, conn, readbuf[4:], 4, len(readbuf))
+}
+
+// isBigEndianMagic returns whether magic, decoded as little-endian, is
+// expected in big-endian byte order.
+func isBigEndianMagic(magic, expected uint32) bool {
+	return magic == bits.ReverseBytes32(expected)
+}
+
+// readResponse fills buf with the part of the response that starts at
+// offset. A single read can return less than requested so this keeps reading
+// until all bytes have arrived. Must be called with the mutex held.
+func (p *P0fClient) readResponse(ctx context.Context, conn io.Reader, buf []byte, offset, total int) error {
+	n, err := readFull(conn, buf)
+	p.lastRead = offset + n
+	if errors.Is(err, io.ErrUnexpectedEOF) || (errors.Is(err, io.EOF) && offset > 0) {
+		return fmt.Errorf("reading from socket: got %d of %d response bytes: %w", offset+n, total, ErrSocketCommunication)
+	}
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("reading from socket: %w", ErrConnectionClosed)
+	}
+	if err != nil {
+		return p.ioError(ctx, "reading from socket", err)
+	}
+
+	return nil
+}
+
+// maxEmptyReads is the number of reads in a row that may return no data and
+// no error before readFull gives up.
+const maxEmptyReads = 100
+
+// maxTemporaryRetries is the number of times a read or write that failed
+// with a temporary error is retried before giving up.
+const maxTemporaryRetries = 3
+
+// isTemporary returns whether err is a temporary error after which the read
+// or write can be retried, such as an interrupted system call. Timeouts are
+// not temporary here as they are caused by the deadline of the query.
+func isTemporary(err error) bool {
+	if errors.Is(err, syscall.EINTR) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Temporary() && !netErr.Timeout()
+}
+
+// writeFull writes all of buf to w, retrying up to maxTemporaryRetries times
+// if a write fails with a temporary error.
+func writeFull(w io.Writer, buf []byte) error {
+	retries := 0
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		buf = buf[n:]
+		if err == nil {
+			continue
+		}
+		if !isTemporary(err) || retries >= maxTemporaryRetries {
+			return err
+		}
+		retries++
+	}
+	return nil
+}
+
+// readFull is like io.ReadFull but returns io.ErrNoProgress instead of
+// spinning forever on a reader that keeps returning no data and no error.
+// Reads that fail with a temporary error are retried up to
+// maxTemporaryRetries times.
+func readFull(r io.Reader, buf []byte) (int, error) {
+	n, empty, retries := 0, 0, 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if n == len(buf) {
+			break
+		}
+		if err != nil && isTemporary(err) && retries < maxTemporaryRetries {
+			retries++
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+
+		if m > 0 {
+			empty = 0
+		} else if empty++; empty >= maxEmptyReads {
+			return n, io.ErrNoProgress
+		}
+	}
+	return n, nil
+}
+
+// invalidate closes the connection and marks the client as not connected.
+// Must be called with the mutex held.
+func (p *P0fClient) invalidate() {
+	if p.connection != nil {
+		closeConn(p.connection)
+		p.connection = nil
+	}
+}
+
+// deadlineSetter is implemented by connections that support deadlines, such
+// as net.Conn.
+type deadlineSetter interface {
+	SetDeadline(t time.Time) error
+}
+
+// readWriteDeadlineSetter is implemented by connections that support
+// separate read and write deadlines, such as net.Conn.
+type readWriteDeadlineSetter interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// setConnDeadline sets the deadline on conn if it supports deadlines.
+func setConnDeadline(conn io.ReadWriter, t time.Time) {
+	if d, ok := conn.(deadlineSetter); ok {
+		d.SetDeadline(t)
+	}
+}
+
+// closeConn closes conn if it can be closed.
+func closeConn(conn io.ReadWriter) error {
+	if c, ok := conn.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// backoff returns the time to wait before the given reconnect attempt.
+func backoff(attempt int) time.Duration {
+	return exponentialBackoff(reconnectBackoff, maxReconnectBackoff, attempt)
+}
+
+// exponentialBackoff returns initial doubled attempt times, capped at
+// maximum.
+func exponentialBackoff(initial, maximum time.Duration, attempt int) time.Duration {
+	d := initial
+	for i := 0; i < attempt && d < maximum; i++ {
+		d *= 2
+	}
+	return min(d, maximum)
+}
+
+// sleepContext waits for the given duration or until the context is done,
+// whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// watchContext makes sure that a cancellation of the context unblocks any
+// pending I/O on the connection. This only works for connections that support
+// deadlines. The returned function must be called once the I/O is done; it
+// clears the deadline again.
+func watchContext(ctx context.Context, conn io.ReadWriter) func() {
+	if ctx.Done() == nil {
+		return func() {
+			setConnDeadline(conn, time.Time{})
+		}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			// Setting a deadline in the past makes pending reads and writes
+			// return immediately.
+			setConnDeadline(conn, time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+		setConnDeadline(conn, time.Time{})
+	}
+}
+
+// setDeadline sets the deadline for the next read or write on the
+// connection. This is the earliest of the configured timeout, the deadline of
+// the context and the read or write deadline set by the user. The context is
+// checked after setting the deadline so that a cancellation that raced with
+// it is never lost. Must be called with the mutex held.
+func (p *P0fClient) setDeadline(ctx context.Context, conn io.ReadWriter) error {
+	var deadline time.Time
+	if p.timeout > 0 {
+		deadline = time.Now().Add(p.timeout)
+	}
+
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+
+	read := earliest(deadline, p.readDeadline)
+	write := earliest(deadline, p.writeDeadline)
+	if rw, ok := conn.(readWriteDeadlineSetter); ok && !read.Equal(write) {
+		rw.SetReadDeadline(read)
+		rw.SetWriteDeadline(write)
+	} else {
+		setConnDeadline(conn, earliest(read, write))
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if p.canceled.Load() {
+		return ErrQueryCanceled
+	}
+	return nil
+}
+
+// earliest returns the earliest of the two times, where the zero time means
+// no deadline.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// ioError converts an error that occurred while reading or writing to the
+// socket into the error that is returned to the caller.
+func (p *P0fClient) ioError(ctx context.Context, op string, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	if p.canceled.Load() {
+		return fmt.Errorf("%s: %w", op, ErrQueryCanceled)
+	}
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+			return context.DeadlineExceeded
+		}
+		return fmt.Errorf("%s: %w", op, ErrTimeout)
+	}
+
+	if isConnectionClosed(err) {
+		return fmt.Errorf("%s: %w", op, ErrConnectionClosed)
+	}
+
+	return fmt.Errorf("%s: %w", op, ErrSocketCommunication)
+}
+
+// CancelOngoing aborts the query that is in progress, if any, by making its
+// pending read or write on the connection return right away. It is meant for
+// a supervising goroutine that detects a hung query; prefer QueryIPContext
+// where possible. The aborted query returns ErrQueryCanceled and, as the
+// answer of p0f may still arrive, closes the connection, so Connect has to be
+// called again. CancelOngoing returns false if no query was in progress.
+func (p *P0fClient) CancelOngoing() bool {
+	p.cancelMu.Lock()
+	defer p.cancelMu.Unlock()
+
+	if p.inflight == nil {
+		return false
+	}
+
+	// The flag is set before the deadline so that a query that sets a new
+	// deadline after this one still notices the cancellation.
+	p.canceled.Store(true)
+	setConnDeadline(p.inflight, time.Unix(1, 0))
+	return true
+}
+
+// beginInflight registers conn as the connection of the query in progress
+// for CancelOngoing. The returned function unregisters it again.
+func (p *P0fClient) beginInflight(conn io.ReadWriter) func() {
+	p.cancelMu.Lock()
+	p.inflight = conn
+	p.canceled.Store(false)
+	p.cancelMu.Unlock()
+
+	return func() {
+		p.cancelMu.Lock()
+		p.inflight = nil
+		p.cancelMu.Unlock()
+	}
+}
+
+// IsConnected returns true if the client has a connection to p0f. The
+// connection is dropped after a timeout, a cancelled query or another
+// communication error, or by Stop. It is not checked that p0f still listens
+// on the other end; use Ping for that. With per-query connections enabled
+// the client never holds a connection and IsConnected returns false.
+func (p *P0fClient) IsConnected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connection != nil
+}
+
+// isConnectionClosed returns true if err means that the connection is gone:
+// p0f closed or reset it, which shows as a broken pipe on write, or the
+// connection itself was closed.
+func isConnectionClosed(err error) bool {
+	return errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, os.ErrClosed)
+}
+
+// Stop closes the connection to the p0f socket. The client can be connected
+// again with Connect. Calling Stop on a client that is not connected, or
+// whose connection was already closed, does nothing and returns nil. A query
+// that is waiting to retry with auto reconnect returns ErrNotConnected.
+func (p *P0fClient) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stops++
+	if p.connection == nil {
+		return nil
+	}
+
+	err := closeConn(p.connection)
+	p.connection = nil
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// P0fClient implements io.Closer.
+var _ io.Closer = (*P0fClient)(nil)
+
+// Close is the same as Stop. It makes P0fClient an io.Closer so it can be
+// used with defer and cleanup helpers that expect one.
+func (p *P0fClient) Close() error {
+	return p.Stop()
 }
@@ -1,11 +1,65 @@
 package p0fclient
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
+// startTestServer listens on a temporary unix socket and calls handle for
+// every accepted connection. It returns the path of the socket.
+func startTestServer(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "p0f.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("could not listen on %s: %s", socket, err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	return socket
+}
+
+// answerQueries answers every query read from conn with resp.
+func answerQueries(conn net.Conn, resp Response) {
+	defer conn.Close()
+
+	var query Query
+	for binary.Read(conn, binary.LittleEndian, &query) == nil {
+		if binary.Write(conn, binary.LittleEndian, resp) != nil {
+			return
+		}
+	}
+}
+
+var okResponse = Response{
+	Magic:  P0F_RESPONSE_MAGIC,
+	Status: P0F_STATUS_OK,
+}
+
 func TestP0fClientStart(t *testing.T) {
 	for _, test := range []struct {
 		description   string
@@ -46,7 +100,7 @@ func TestP0fCreateQueryIPv4(t *testing.T) {
 	for _, test := range []struct {
 		description  string
 		ip           string
-		expectedType uint8
+		expectedType AddressType
 	}{
 		{
 			description:  "IPv4 address, OK",
@@ -69,8 +123,2429 @@ func TestP0fCreateQueryIPv4(t *testing.T) {
 			}
 
 			if query.AddressType != test.expectedType {
-				t.Errorf("expected type %d, got %d", test.expectedType, query.AddressType)
+				t.Errorf("expected type %s, got %s", test.expectedType, query.AddressType)
+			}
+		})
+	}
+}
+
+func TestP0fQueryIPContext(t *testing.T) {
+	t.Run("context already cancelled", func(t *testing.T) {
+		// The connection is left nil on purpose; the socket must not be
+		// touched when the context is already done.
+		pc := NewP0fClient("")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := pc.QueryIPContext(ctx, net.ParseIP("127.0.0.1"))
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	})
+
+	t.Run("deadline exceeded while reading", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+		go io.Copy(io.Discard, server)
+
+		pc := NewP0fClient("")
+		pc.connection = client
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := pc.QueryIPContext(ctx, net.ParseIP("127.0.0.1"))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, got %v", err)
+		}
+	})
+}
+
+func TestP0fQueryIPTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	pc := NewP0fClient("")
+	pc.connection = client
+	pc.SetTimeout(50 * time.Millisecond)
+
+	_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+
+	if !errors.Is(err, ErrSocketCommunication) {
+		t.Errorf("expected error to wrap ErrSocketCommunication, got %v", err)
+	}
+}
+
+func TestP0fAutoReconnect(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		maxRetries  int
+		expectError bool
+	}{
+		{
+			description: "reconnect disabled",
+			maxRetries:  0,
+			expectError: true,
+		},
+		{
+			description: "reconnect enabled",
+			maxRetries:  2,
+			expectError: false,
+		},
+	} {
+
+		t.Run(test.description, func(t *testing.T) {
+			var connections atomic.Int32
+			socket := startTestServer(t, func(conn net.Conn) {
+				// The first connection is dropped to simulate p0f going away.
+				if connections.Add(1) == 1 {
+					conn.Close()
+					return
+				}
+				answerQueries(conn, okResponse)
+			})
+
+			pc := NewP0fClient(socket)
+			pc.SetAutoReconnect(test.maxRetries)
+			if err := pc.Connect(); err != nil {
+				t.Fatalf("could not connect: %s", err)
+			}
+			defer pc.Stop()
+
+			_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+			if test.expectError {
+				if !errors.Is(err, ErrSocketCommunication) {
+					t.Errorf("expected ErrSocketCommunication, got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("expected no error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestP0fQueryString(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	if _, err := pc.QueryString("127.0.0.1"); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+
+	_, err := pc.QueryString("not an ip")
+	if err == nil || !strings.Contains(err.Error(), "invalid IP address") {
+		t.Errorf("expected invalid IP address error, got %v", err)
+	}
+}
+
+func TestP0fQueryAddr(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	ip := net.ParseIP("192.0.2.1")
+	for _, test := range []struct {
+		description string
+		addr        net.Addr
+		expectError bool
+	}{
+		{description: "tcp", addr: &net.TCPAddr{IP: ip, Port: 80}},
+		{description: "udp", addr: &net.UDPAddr{IP: ip, Port: 53}},
+		{description: "ip", addr: &net.IPAddr{IP: ip}},
+		{description: "unix", addr: &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, expectError: true},
+		{description: "nil tcp", addr: (*net.TCPAddr)(nil), expectError: true},
+		{description: "nil", addr: nil, expectError: true},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			_, err := pc.QueryAddr(test.addr)
+			if test.expectError != (err != nil) {
+				t.Errorf("expected error %t, got %v", test.expectError, err)
 			}
 		})
 	}
 }
+
+func TestP0fQueryHost(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	responses, err := pc.QueryHost(context.Background(), "localhost")
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if len(responses) == 0 || responses[0] == nil {
+		t.Errorf("expected a response per address, got %v", responses)
+	}
+
+	if _, err := pc.QueryHost(context.Background(), "host.invalid"); err == nil {
+		t.Errorf("expected an error for a host that does not resolve")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pc.QueryHost(ctx, "localhost"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestP0fQueryIPs(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	ips := []net.IP{
+		net.ParseIP("127.0.0.1"),
+		nil,
+		net.ParseIP("::1"),
+	}
+
+	responses, errs := pc.QueryIPs(ips)
+	if len(responses) != len(ips) || len(errs) != len(ips) {
+		t.Fatalf("expected %d results, got %d responses and %d errors", len(ips), len(responses), len(errs))
+	}
+
+	for i, expectError := range []bool{false, true, false} {
+		if expectError {
+			if errs[i] == nil || responses[i] != nil {
+				t.Errorf("expected error for index %d, got %v", i, errs[i])
+			}
+			continue
+		}
+
+		if errs[i] != nil || responses[i] == nil {
+			t.Errorf("expected response for index %d, got error %v", i, errs[i])
+		}
+	}
+}
+
+func TestP0fShortResponse(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		if binary.Read(conn, binary.LittleEndian, &query) != nil {
+			return
+		}
+
+		// Send the response in two parts with a pause in between and then
+		// hang up before all bytes were sent.
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, okResponse)
+		conn.Write(buf.Bytes()[:10])
+		time.Sleep(10 * time.Millisecond)
+		conn.Write(buf.Bytes()[10:100])
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if !errors.Is(err, ErrSocketCommunication) {
+		t.Errorf("expected ErrSocketCommunication, got %v", err)
+	}
+
+	if err == nil || !strings.Contains(err.Error(), "got 100 of") {
+		t.Errorf("expected error to mention the received bytes, got %v", err)
+	}
+}
+
+func TestP0fSplitResponse(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		if binary.Read(conn, binary.LittleEndian, &query) != nil {
+			return
+		}
+
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, okResponse)
+		conn.Write(buf.Bytes()[:10])
+		time.Sleep(10 * time.Millisecond)
+		conn.Write(buf.Bytes()[10:])
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+func TestP0fQueryNotConnected(t *testing.T) {
+	pc := NewP0fClient("/tmp/dsddsdsskdldewu89783jjkjjk")
+
+	_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if err == nil || !strings.Contains(err.Error(), "not connected") {
+		t.Errorf("expected not connected error, got %v", err)
+	}
+
+	_, errs := pc.QueryIPs([]net.IP{net.ParseIP("127.0.0.1")})
+	if errs[0] == nil || !strings.Contains(errs[0].Error(), "not connected") {
+		t.Errorf("expected not connected error, got %v", errs[0])
+	}
+}
+
+func TestP0fConnectTwice(t *testing.T) {
+	closed := make(chan struct{}, 2)
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+		closed <- struct{}{}
+	})
+
+	pc := NewP0fClient(socket)
+	for i := 0; i < 2; i++ {
+		if err := pc.Connect(); err != nil {
+			t.Fatalf("could not connect: %s", err)
+		}
+	}
+	defer pc.Stop()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Errorf("first connection was not closed")
+	}
+
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+func TestNewP0fClientConn(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("could not dial: %s", err)
+	}
+
+	pc := NewP0fClientConn(conn, WithTimeout(time.Second))
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("expected Connect to do nothing, got %s", err)
+	}
+	if _, err := pc.QueryIP(net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	if err := pc.Stop(); err != nil {
+		t.Fatalf("could not stop: %s", err)
+	}
+	if _, err := conn.Write([]byte{0}); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected Stop to close the connection, got %v", err)
+	}
+
+	if _, err := pc.QueryIP(net.ParseIP("192.0.2.1")); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected after Stop, got %v", err)
+	}
+	var connectErr *ConnectError
+	if err := pc.Connect(); !errors.As(err, &connectErr) {
+		t.Errorf("expected a ConnectError connecting after Stop, got %v", err)
+	}
+	if err := pc.Reconnect(socket); !errors.As(err, &connectErr) {
+		t.Errorf("expected a ConnectError reconnecting, got %v", err)
+	}
+}
+
+func TestP0fConcurrentQueryAndReconnect(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket, WithAutoReconnect(3))
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				// A query can run right after Stop and before the next
+				// Connect, so only a missing connection is expected.
+				if _, err := pc.QueryIP(net.ParseIP("192.0.2.1")); err != nil && !errors.Is(err, ErrNotConnected) {
+					t.Errorf("expected no error, got %s", err)
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 20; j++ {
+			switch j % 3 {
+			case 0:
+				if err := pc.Reconnect(socket); err != nil {
+					t.Errorf("could not reconnect: %s", err)
+				}
+			case 1:
+				pc.SetSocket(socket)
+				pc.Stop()
+				if err := pc.Connect(); err != nil {
+					t.Errorf("could not connect: %s", err)
+				}
+			case 2:
+				// Make the next query fail so that auto reconnect swaps
+				// the connection.
+				pc.mu.Lock()
+				if conn, ok := pc.connection.(net.Conn); ok {
+					conn.Close()
+				}
+				pc.mu.Unlock()
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestP0fQueryMap(t *testing.T) {
+	var queries atomic.Int32
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		for binary.Read(conn, binary.LittleEndian, &query) == nil {
+			queries.Add(1)
+			if binary.Write(conn, binary.LittleEndian, okResponse) != nil {
+				return
+			}
+		}
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	results, err := pc.QueryMap([]net.IP{
+		net.ParseIP("192.0.2.1"),
+		nil,
+		net.ParseIP("2001:db8::1"),
+		net.IP{1, 2, 3},
+		net.ParseIP("::ffff:192.0.2.1"),
+		net.ParseIP("192.0.2.1").To4(),
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	if len(results) != 2 || results["192.0.2.1"] == nil || results["2001:db8::1"] == nil {
+		t.Errorf("expected responses for 192.0.2.1 and 2001:db8::1, got %v", results)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("expected 2 queries, got %d", n)
+	}
+
+	results, err = pc.QueryMap([]net.IP{net.ParseIP("0.0.0.0"), net.ParseIP("192.0.2.1")})
+	if !errors.Is(err, ErrUnspecifiedIP) || !strings.Contains(err.Error(), "0.0.0.0") {
+		t.Errorf("expected ErrUnspecifiedIP for 0.0.0.0, got %v", err)
+	}
+	if len(results) != 1 || results["192.0.2.1"] == nil {
+		t.Errorf("expected the successful response to be kept, got %v", results)
+	}
+}
+
+func TestP0fStopThenConnect(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+
+	if err := pc.Stop(); err != nil {
+		t.Fatalf("could not stop: %s", err)
+	}
+
+	_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if err == nil || !strings.Contains(err.Error(), "not connected") {
+		t.Errorf("expected not connected error, got %v", err)
+	}
+
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect again: %s", err)
+	}
+	defer pc.Stop()
+
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+func TestP0fIsConnected(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		// Never answer so that the query times out.
+		io.Copy(io.Discard, conn)
+	})
+
+	pc := NewP0fClient(socket, WithTimeout(20*time.Millisecond))
+	if pc.IsConnected() {
+		t.Errorf("expected not connected before Connect")
+	}
+
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	if !pc.IsConnected() {
+		t.Errorf("expected connected after Connect")
+	}
+
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if pc.IsConnected() {
+		t.Errorf("expected not connected after a timeout")
+	}
+
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	pc.Stop()
+	if pc.IsConnected() {
+		t.Errorf("expected not connected after Stop")
+	}
+}
+
+func TestP0fStopTwice(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Stop(); err != nil {
+		t.Errorf("stop without connect: expected no error, got %s", err)
+	}
+
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := pc.Stop(); err != nil {
+			t.Errorf("stop %d: expected no error, got %s", i+1, err)
+		}
+	}
+}
+
+func TestP0fStopClosedConnection(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+
+	// Close the connection underneath the client.
+	pc.connection.(net.Conn).Close()
+	if err := pc.Stop(); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	if pc.IsConnected() {
+		t.Errorf("expected not connected after Stop")
+	}
+}
+
+func TestP0fQueryAfterCancelledQuery(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		for binary.Read(conn, binary.LittleEndian, &query) == nil {
+			// Answer with the queried address so that a stale answer can be
+			// told apart from the right one.
+			resp := okResponse
+			copy(resp.OsName[:], net.IP(query.Address[:4]).String())
+			time.Sleep(100 * time.Millisecond)
+			if binary.Write(conn, binary.LittleEndian, resp) != nil {
+				return
+			}
+		}
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := pc.QueryIPContext(ctx, net.ParseIP("10.0.0.1"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	resp, err := pc.QueryIP(net.ParseIP("10.0.0.2"))
+	if err == nil {
+		t.Fatalf("expected an error after the cancelled query, got response for %s", resp.OsNameString())
+	}
+
+	if !strings.Contains(err.Error(), "not connected") {
+		t.Errorf("expected not connected error, got %v", err)
+	}
+
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not reconnect: %s", err)
+	}
+
+	resp, err = pc.QueryIP(net.ParseIP("10.0.0.2"))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	if got := resp.OsNameString(); got != "10.0.0.2" {
+		t.Errorf("expected answer for 10.0.0.2, got answer for %s", got)
+	}
+}
+
+func TestP0fQueryIPsTimeout(t *testing.T) {
+	var queries atomic.Int32
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		for binary.Read(conn, binary.LittleEndian, &query) == nil {
+			// Only the first query is answered too late.
+			if queries.Add(1) == 1 {
+				time.Sleep(100 * time.Millisecond)
+			}
+			if binary.Write(conn, binary.LittleEndian, okResponse) != nil {
+				return
+			}
+		}
+	})
+
+	pc := NewP0fClient(socket)
+	pc.SetTimeout(50 * time.Millisecond)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	responses, errs := pc.QueryIPs([]net.IP{
+		net.ParseIP("10.0.0.1"),
+		net.ParseIP("10.0.0.2"),
+	})
+
+	if !errors.Is(errs[0], ErrTimeout) {
+		t.Errorf("expected ErrTimeout for the first query, got %v", errs[0])
+	}
+
+	// The late answer to the first query must not be used for the second.
+	if responses[1] != nil || errs[1] == nil {
+		t.Errorf("expected an error for the second query, got %v", errs[1])
+	}
+}
+
+func TestP0fQueryIPsPipelined(t *testing.T) {
+	const batch = 3
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		// Only answer once all queries of the batch have arrived, which
+		// fails if the client waits for a response before sending the next
+		// query.
+		queries := make([]Query, batch)
+		if binary.Read(conn, binary.LittleEndian, queries) != nil {
+			return
+		}
+		for _, query := range queries {
+			resp := okResponse
+			resp.Distance = int16(query.Address[3])
+			if binary.Write(conn, binary.LittleEndian, resp) != nil {
+				return
+			}
+		}
+	})
+
+	pc := NewP0fClient(socket)
+	pc.SetTimeout(time.Second)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	ips := []net.IP{
+		net.ParseIP("10.0.0.1"),
+		net.ParseIP("10.0.0.2"),
+		nil,
+		net.ParseIP("10.0.0.3"),
+	}
+
+	responses, errs := pc.QueryIPsPipelined(ips)
+	if len(responses) != len(ips) || len(errs) != len(ips) {
+		t.Fatalf("expected %d results, got %d responses and %d errors", len(ips), len(responses), len(errs))
+	}
+
+	if errs[2] == nil || responses[2] != nil {
+		t.Errorf("expected error for index 2, got %v", errs[2])
+	}
+
+	for i, distance := range map[int]int16{0: 1, 1: 2, 3: 3} {
+		if errs[i] != nil || responses[i] == nil {
+			t.Errorf("expected response for index %d, got error %v", i, errs[i])
+			continue
+		}
+		if responses[i].Distance != distance {
+			t.Errorf("expected distance %d for index %d, got %d", distance, i, responses[i].Distance)
+		}
+	}
+}
+
+func TestP0fQueryIPsPipelinedNotConnected(t *testing.T) {
+	pc := NewP0fClient("/tmp/unused.sock")
+
+	_, errs := pc.QueryIPsPipelined([]net.IP{net.ParseIP("10.0.0.1")})
+	if !errors.Is(errs[0], ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected, got %v", errs[0])
+	}
+}
+
+func TestP0fBackoff(t *testing.T) {
+	for _, test := range []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{attempt: 0, expected: 100 * time.Millisecond},
+		{attempt: 1, expected: 200 * time.Millisecond},
+		{attempt: 3, expected: 800 * time.Millisecond},
+		{attempt: 6, expected: 5 * time.Second},
+		{attempt: 100, expected: 5 * time.Second},
+	} {
+		if got := backoff(test.attempt); got != test.expected {
+			t.Errorf("attempt %d: expected %s, got %s", test.attempt, test.expected, got)
+		}
+	}
+}
+
+func TestP0fStopDuringBackoff(t *testing.T) {
+	var connections atomic.Int32
+	dropped := make(chan struct{})
+	socket := startTestServer(t, func(conn net.Conn) {
+		if connections.Add(1) > 1 {
+			answerQueries(conn, okResponse)
+			return
+		}
+
+		// Send part of a response so that the query is retried after a
+		// backoff.
+		var query Query
+		binary.Read(conn, binary.LittleEndian, &query)
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, okResponse)
+		conn.Write(buf.Bytes()[:10])
+		conn.Close()
+		close(dropped)
+	})
+
+	pc := NewP0fClient(socket, WithAutoReconnect(3))
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+
+	queried := make(chan error, 1)
+	go func() {
+		_, err := pc.QueryIP(net.ParseIP("192.0.2.1"))
+		queried <- err
+	}()
+
+	<-dropped
+	time.Sleep(reconnectBackoff / 4)
+	if err := pc.Close(); err != nil {
+		t.Fatalf("could not close: %s", err)
+	}
+
+	if err := <-queried; !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected, got %v", err)
+	}
+	if pc.IsConnected() {
+		t.Errorf("expected not connected after Close")
+	}
+	if n := connections.Load(); n != 1 {
+		t.Errorf("expected no reconnect after Close, got %d connections", n)
+	}
+}
+
+func TestP0fAutoReconnectFails(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		conn.Close()
+	})
+
+	pc := NewP0fClient(socket)
+	pc.SetAutoReconnect(1)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	// Point the client at a socket that does not exist so the reconnect
+	// fails.
+	pc.SetSocket("/tmp/dsddsdsskdldewu89783jjkjjk")
+	_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if !errors.Is(err, ErrSocketCommunication) {
+		t.Errorf("expected ErrSocketCommunication, got %v", err)
+	}
+
+	_, err = pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if err == nil || !strings.Contains(err.Error(), "not connected") {
+		t.Errorf("expected not connected error, got %v", err)
+	}
+}
+
+func TestP0fBadQueryResponse(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, Response{
+			Magic:  P0F_RESPONSE_MAGIC,
+			Status: P0F_STATUS_BADQUERY,
+		})
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if !errors.Is(err, ErrBadQuery) {
+		t.Errorf("expected bad query error, got %v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "ipv4 address 127.0.0.1") {
+		t.Errorf("expected the query in the error, got %v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "address type byte 0x04, query bytes 01 46 30 50 04 7f 00 00 01 00") {
+		t.Errorf("expected the sent bytes in the error, got %v", err)
+	}
+}
+
+func TestP0fClientNet(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go answerQueries(conn, okResponse)
+		}
+	}()
+
+	pc := NewP0fClientNet("tcp", l.Addr().String())
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+func TestIsFilesystemSocket(t *testing.T) {
+	for _, test := range []struct {
+		network  string
+		address  string
+		expected bool
+	}{
+		{network: "unix", address: "/var/run/p0f.sock", expected: true},
+		{network: "unixpacket", address: "/var/run/p0f.sock", expected: true},
+		{network: "unix", address: "@p0f", expected: false},
+		{network: "unix", address: "\x00p0f", expected: false},
+		{network: "tcp", address: "127.0.0.1:1234", expected: false},
+	} {
+		if got := isFilesystemSocket(test.network, test.address); got != test.expected {
+			t.Errorf("%s %q: expected %t, got %t", test.network, test.address, test.expected, got)
+		}
+	}
+}
+
+func TestP0fValidateResponse(t *testing.T) {
+	for _, test := range []struct {
+		description   string
+		resp          Response
+		errorContains string
+	}{
+		{
+			description: "exact match",
+			resp:        Response{Magic: P0F_RESPONSE_MAGIC, Status: P0F_STATUS_OK},
+		},
+		{
+			description: "fuzzy and generic match",
+			resp: Response{
+				Magic:    P0F_RESPONSE_MAGIC,
+				Status:   P0F_STATUS_OK,
+				OsMatchQ: P0F_MATCH_FUZZY | P0F_MATCH_GENERIC,
+			},
+		},
+		{
+			description:   "unknown match quality",
+			resp:          Response{Magic: P0F_RESPONSE_MAGIC, Status: P0F_STATUS_OK, OsMatchQ: 0x04},
+			errorContains: "unknown OS match quality",
+		},
+		{
+			description:   "unknown status",
+			resp:          Response{Magic: P0F_RESPONSE_MAGIC, Status: 0x30},
+			errorContains: "unknown response status",
+		},
+	} {
+
+		t.Run(test.description, func(t *testing.T) {
+			socket := startTestServer(t, func(conn net.Conn) {
+				answerQueries(conn, test.resp)
+			})
+
+			pc := NewP0fClient(socket)
+			if err := pc.Connect(); err != nil {
+				t.Fatalf("could not connect: %s", err)
+			}
+			defer pc.Stop()
+
+			_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+			if test.errorContains == "" {
+				if err != nil {
+					t.Errorf("expected no error, got %s", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.errorContains) {
+				t.Errorf("expected error containing %q, got %v", test.errorContains, err)
+			}
+		})
+	}
+}
+
+func TestP0fPing(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, Response{
+			Magic:  P0F_RESPONSE_MAGIC,
+			Status: P0F_STATUS_NOMATCH,
+		})
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Ping(); err == nil {
+		t.Errorf("expected an error pinging without a connection")
+	}
+
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	if err := pc.Ping(); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+// benchmarkClient returns a client connected to a server that answers every
+// query with okResponse.
+func benchmarkClient(b *testing.B, opts ...Option) *P0fClient {
+	b.Helper()
+
+	socket := filepath.Join(b.TempDir(), "p0f.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		b.Fatalf("could not listen on %s: %s", socket, err)
+	}
+	b.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go answerQueries(conn, okResponse)
+		}
+	}()
+
+	pc := NewP0fClient(socket, opts...)
+	if err := pc.Connect(); err != nil {
+		b.Fatalf("could not connect: %s", err)
+	}
+	b.Cleanup(func() { pc.Stop() })
+	return pc
+}
+
+func BenchmarkP0fBufferPool(b *testing.B) {
+	for _, test := range []struct {
+		description string
+		bufferPool  bool
+	}{
+		{description: "buffer per client", bufferPool: false},
+		{description: "buffer pool", bufferPool: true},
+	} {
+		b.Run(test.description, func(b *testing.B) {
+			// Per-query connections create a client, and without the pool a
+			// buffer, for every query.
+			pc := benchmarkClient(b, WithPerQueryConnection(true), WithBufferPool(test.bufferPool))
+
+			ip := net.ParseIP("127.0.0.1")
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var resp Response
+				for pb.Next() {
+					if err := pc.QueryIPInto(ip, &resp); err != nil {
+						b.Errorf("query failed: %s", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// countingConn counts the reads done on the connection, each of which is a
+// syscall.
+type countingConn struct {
+	net.Conn
+	reads *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	c.reads.Add(1)
+	return c.Conn.Read(p)
+}
+
+// benchmarkBatch runs query on batches of 100 addresses and reports the
+// number of reads per batch.
+func benchmarkBatch(b *testing.B, query func(*P0fClient, []net.IP) ([]*Response, []error)) {
+	var reads atomic.Int64
+	pc := benchmarkClient(b, WithDialFunc(func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		return countingConn{Conn: conn, reads: &reads}, err
+	}))
+
+	ips := make([]net.IP, 100)
+	for i := range ips {
+		ips[i] = net.IPv4(10, 0, 0, byte(i))
+	}
+
+	reads.Store(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, errs := query(pc, ips); errs[0] != nil {
+			b.Fatalf("query failed: %s", errs[0])
+		}
+	}
+	b.ReportMetric(float64(reads.Load())/float64(b.N), "reads/op")
+}
+
+func BenchmarkP0fQueryIPs(b *testing.B) {
+	benchmarkBatch(b, (*P0fClient).QueryIPs)
+}
+
+func BenchmarkP0fQueryIPsPipelined(b *testing.B) {
+	benchmarkBatch(b, (*P0fClient).QueryIPsPipelined)
+}
+
+func BenchmarkP0fQueryIP(b *testing.B) {
+	pc := benchmarkClient(b)
+
+	ip := net.ParseIP("127.0.0.1")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pc.QueryIP(ip); err != nil {
+			b.Fatalf("query failed: %s", err)
+		}
+	}
+}
+
+func BenchmarkP0fQueryIPInto(b *testing.B) {
+	pc := benchmarkClient(b)
+
+	ip := net.ParseIP("127.0.0.1")
+	var resp Response
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := pc.QueryIPInto(ip, &resp); err != nil {
+			b.Fatalf("query failed: %s", err)
+		}
+	}
+}
+
+func TestP0fCreateQueryMalformedIP(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		ip          net.IP
+	}{
+		{
+			description: "nil IP",
+			ip:          nil,
+		},
+		{
+			description: "too short",
+			ip:          net.IP{1, 2, 3},
+		},
+		{
+			description: "too long",
+			ip:          make(net.IP, 17),
+		},
+	} {
+
+		t.Run(test.description, func(t *testing.T) {
+			if _, err := createQueryForIP(test.ip); err == nil {
+				t.Errorf("expected an error for %v", []byte(test.ip))
+			}
+		})
+	}
+}
+
+func TestP0fCreateQueryAddress(t *testing.T) {
+	query, err := createQueryForIP(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("error creating query: %s", err)
+	}
+
+	expected := [16]uint8{192, 0, 2, 1}
+	if query.Address != expected {
+		t.Errorf("expected address %v, got %v", expected, query.Address)
+	}
+}
+
+func TestP0fQueryIPsContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var queries atomic.Int32
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		for binary.Read(conn, binary.LittleEndian, &query) == nil {
+			// Cancel the batch while the second query is handled.
+			if queries.Add(1) == 2 {
+				cancel()
+			}
+			if binary.Write(conn, binary.LittleEndian, okResponse) != nil {
+				return
+			}
+		}
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	ips := []net.IP{
+		net.ParseIP("10.0.0.1"),
+		net.ParseIP("10.0.0.2"),
+		net.ParseIP("10.0.0.3"),
+		net.ParseIP("10.0.0.4"),
+	}
+
+	responses, errs := pc.QueryIPsContext(ctx, ips)
+	if responses[0] == nil || errs[0] != nil {
+		t.Errorf("expected a response for the first query, got %v", errs[0])
+	}
+
+	for i := 2; i < len(ips); i++ {
+		if responses[i] != nil || !errors.Is(errs[i], context.Canceled) {
+			t.Errorf("expected context.Canceled for index %d, got %v", i, errs[i])
+		}
+	}
+}
+
+func TestP0fReconnect(t *testing.T) {
+	first := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, Response{Magic: P0F_RESPONSE_MAGIC, Status: P0F_STATUS_NOMATCH})
+	})
+	second := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(first)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	// A failing reconnect keeps the old connection.
+	if err := pc.Reconnect("/tmp/dsddsdsskdldewu89783jjkjjk"); err == nil {
+		t.Errorf("expected an error reconnecting to a missing socket")
+	}
+
+	resp, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if err != nil || resp.Status != P0F_STATUS_NOMATCH {
+		t.Fatalf("expected answer from the first socket, got %v, %v", resp, err)
+	}
+
+	if err := pc.Reconnect(second); err != nil {
+		t.Fatalf("could not reconnect: %s", err)
+	}
+
+	resp, err = pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if err != nil || resp.Status != P0F_STATUS_OK {
+		t.Errorf("expected answer from the second socket, got %v, %v", resp, err)
+	}
+}
+
+func TestP0fErrors(t *testing.T) {
+	pc := NewP0fClient("/tmp/dsddsdsskdldewu89783jjkjjk")
+
+	err := pc.Connect()
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) {
+		t.Fatalf("expected a ConnectError, got %v", err)
+	}
+
+	if connectErr.Address != "/tmp/dsddsdsskdldewu89783jjkjjk" || connectErr.Network != "unix" {
+		t.Errorf("unexpected address in ConnectError: %s %s", connectErr.Network, connectErr.Address)
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ConnectError to wrap os.ErrNotExist, got %v", err)
+	}
+
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected, got %v", err)
+	}
+
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, Response{Magic: 0x1234, Status: P0F_STATUS_OK})
+	})
+
+	pc = NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("expected ErrBadMagic, got %v", err)
+	}
+}
+
+// bufferPair is an in-memory connection. Queries are written to written and
+// responses are read from toRead. The first emptyReads reads return no data
+// and no error.
+type bufferPair struct {
+	toRead     bytes.Buffer
+	written    bytes.Buffer
+	emptyReads int
+	// readErrs and writeErrs are returned, one per call, before any data is
+	// read or written.
+	readErrs  []error
+	writeErrs []error
+}
+
+func (b *bufferPair) Read(p []byte) (int, error) {
+	if len(b.readErrs) > 0 {
+		err := b.readErrs[0]
+		b.readErrs = b.readErrs[1:]
+		return 0, err
+	}
+	if b.emptyReads > 0 {
+		b.emptyReads--
+		return 0, nil
+	}
+	return b.toRead.Read(p)
+}
+
+func (b *bufferPair) Write(p []byte) (int, error) {
+	if len(b.writeErrs) > 0 {
+		err := b.writeErrs[0]
+		b.writeErrs = b.writeErrs[1:]
+		return 0, err
+	}
+	return b.written.Write(p)
+}
+
+// temporaryError is a net.Error that is temporary but not a timeout.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestP0fQueryTemporaryErrors(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		readErrs    []error
+		writeErrs   []error
+		err         error
+	}{
+		{
+			description: "no errors",
+		},
+		{
+			description: "temporary read errors",
+			readErrs:    []error{temporaryError{}, syscall.EINTR, temporaryError{}},
+		},
+		{
+			description: "temporary write errors",
+			writeErrs:   []error{temporaryError{}, syscall.EINTR},
+		},
+		{
+			description: "too many temporary read errors",
+			readErrs:    []error{temporaryError{}, temporaryError{}, temporaryError{}, temporaryError{}},
+			err:         ErrSocketCommunication,
+		},
+		{
+			description: "too many temporary write errors",
+			writeErrs:   []error{temporaryError{}, temporaryError{}, temporaryError{}, temporaryError{}},
+			err:         ErrSocketCommunication,
+		},
+		{
+			description: "permanent read error",
+			readErrs:    []error{errors.New("broken")},
+			err:         ErrSocketCommunication,
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			rw := &bufferPair{readErrs: test.readErrs, writeErrs: test.writeErrs}
+			binary.Write(&rw.toRead, binary.LittleEndian, okResponse)
+
+			_, err := newP0fClientRW(rw).QueryIP(net.ParseIP("192.0.2.1"))
+			if test.err == nil && err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestP0fQueryReadWriter(t *testing.T) {
+	expected := okResponse
+	copy(expected.OsName[:], "Linux")
+
+	rw := &bufferPair{}
+	if err := binary.Write(&rw.toRead, binary.LittleEndian, expected); err != nil {
+		t.Fatalf("could not encode response: %s", err)
+	}
+
+	pc := newP0fClientRW(rw)
+	resp, err := pc.QueryIP(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	if *resp != expected {
+		t.Errorf("expected %+v, got %+v", expected, *resp)
+	}
+
+	var query Query
+	if err := binary.Read(&rw.written, binary.LittleEndian, &query); err != nil {
+		t.Fatalf("could not decode query: %s", err)
+	}
+
+	if query.Magic != P0F_REQUEST_MAGIC || query.AddressType != P0F_ADDR_IPV4 {
+		t.Errorf("unexpected query header: %+v", query)
+	}
+
+	if rw.written.Len() != 0 {
+		t.Errorf("expected a single query, got %d extra bytes", rw.written.Len())
+	}
+
+	// Nothing is left to read so the next query fails.
+	if _, err := pc.QueryIP(net.ParseIP("192.0.2.1")); !errors.Is(err, ErrSocketCommunication) {
+		t.Errorf("expected ErrSocketCommunication, got %v", err)
+	}
+}
+
+func TestP0fVersionMismatch(t *testing.T) {
+	rw := &bufferPair{}
+	// A response of a made up newer protocol version.
+	rw.toRead.Write([]byte{0x03, 0x46, 0x30, 0x50, 0x10, 0x00, 0x00, 0x00})
+
+	pc := newP0fClientRW(rw)
+	_, err := pc.QueryIP(net.ParseIP("192.0.2.1"))
+	if !errors.Is(err, ErrBadMagic) {
+		t.Fatalf("expected ErrBadMagic, got %v", err)
+	}
+
+	for _, expected := range []string{"version mismatch", "03 46 30 50"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to contain %q, got %s", expected, err)
+		}
+	}
+
+	// The rest of the response was not read so the connection can not be
+	// used anymore.
+	if _, err := pc.QueryIP(net.ParseIP("192.0.2.1")); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected, got %v", err)
+	}
+}
+
+func TestP0fQueryIPFamily(t *testing.T) {
+	types := make(chan AddressType, 1)
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		for binary.Read(conn, binary.LittleEndian, &query) == nil {
+			types <- query.AddressType
+			if binary.Write(conn, binary.LittleEndian, okResponse) != nil {
+				return
+			}
+		}
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	for _, test := range []struct {
+		description  string
+		query        func(net.IP) (*Response, error)
+		ip           net.IP
+		mappedAsIPv6 bool
+		expectedType AddressType
+		expectError  bool
+	}{
+		{
+			description:  "IPv4 as IPv4",
+			query:        pc.QueryIPv4,
+			ip:           net.ParseIP("192.0.2.1"),
+			expectedType: P0F_ADDR_IPV4,
+		},
+		{
+			description: "IPv6 as IPv4",
+			query:       pc.QueryIPv4,
+			ip:          net.ParseIP("2001:db8::1"),
+			expectError: true,
+		},
+		{
+			description:  "IPv6 as IPv6",
+			query:        pc.QueryIPv6,
+			ip:           net.ParseIP("2001:db8::1"),
+			expectedType: P0F_ADDR_IPV6,
+		},
+		{
+			description: "IPv4 as IPv6",
+			query:       pc.QueryIPv6,
+			ip:          net.ParseIP("192.0.2.1").To4(),
+			expectError: true,
+		},
+		{
+			description: "IPv4-mapped IPv6 as IPv6",
+			query:       pc.QueryIPv6,
+			ip:          net.ParseIP("::ffff:192.0.2.1"),
+			expectError: true,
+		},
+		{
+			description:  "mapped mode: IPv4 as IPv4",
+			query:        pc.QueryIPv4,
+			ip:           net.ParseIP("192.0.2.1"),
+			mappedAsIPv6: true,
+			expectedType: P0F_ADDR_IPV4,
+		},
+		{
+			description:  "mapped mode: IPv4-mapped IPv6 as IPv6",
+			query:        pc.QueryIPv6,
+			ip:           net.ParseIP("::ffff:192.0.2.1"),
+			mappedAsIPv6: true,
+			expectedType: P0F_ADDR_IPV6,
+		},
+		{
+			description:  "mapped mode: 4 byte IPv4 as IPv6",
+			query:        pc.QueryIPv6,
+			ip:           net.ParseIP("192.0.2.1").To4(),
+			mappedAsIPv6: true,
+			expectError:  true,
+		},
+	} {
+
+		t.Run(test.description, func(t *testing.T) {
+			pc.SetMappedAsIPv6(test.mappedAsIPv6)
+			_, err := test.query(test.ip)
+			if test.expectError {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if got := <-types; got != test.expectedType {
+				t.Errorf("expected address type %d, got %d", test.expectedType, got)
+			}
+		})
+	}
+}
+
+func TestP0fCreateQueryMapped(t *testing.T) {
+	mapped := net.ParseIP("::ffff:192.0.2.1")
+	for _, test := range []struct {
+		description     string
+		ip              net.IP
+		mappedAsIPv6    bool
+		expectedType    AddressType
+		expectedAddress [16]uint8
+	}{
+		{
+			description:     "mapped address as IPv4",
+			ip:              mapped,
+			mappedAsIPv6:    false,
+			expectedType:    P0F_ADDR_IPV4,
+			expectedAddress: [16]uint8{192, 0, 2, 1},
+		},
+		{
+			description:     "mapped address as IPv6",
+			ip:              mapped,
+			mappedAsIPv6:    true,
+			expectedType:    P0F_ADDR_IPV6,
+			expectedAddress: [16]uint8{10: 0xff, 11: 0xff, 12: 192, 13: 0, 14: 2, 15: 1},
+		},
+		{
+			description:     "4 byte address with mapped as IPv6",
+			ip:              mapped.To4(),
+			mappedAsIPv6:    true,
+			expectedType:    P0F_ADDR_IPV4,
+			expectedAddress: [16]uint8{192, 0, 2, 1},
+		},
+	} {
+
+		t.Run(test.description, func(t *testing.T) {
+			query, err := createQuery(test.ip, test.mappedAsIPv6)
+			if err != nil {
+				t.Fatalf("error creating query: %s", err)
+			}
+
+			if query.AddressType != test.expectedType {
+				t.Errorf("expected type %s, got %s", test.expectedType, query.AddressType)
+			}
+
+			if query.Address != test.expectedAddress {
+				t.Errorf("expected address %v, got %v", test.expectedAddress, query.Address)
+			}
+		})
+	}
+}
+
+func TestP0fClose(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+
+	var closer io.Closer = pc
+	if err := closer.Close(); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected after Close, got %v", err)
+	}
+}
+
+func TestP0fPerQueryConnection(t *testing.T) {
+	var connections atomic.Int32
+	socket := startTestServer(t, func(conn net.Conn) {
+		connections.Add(1)
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	pc.SetPerQueryConnection(true)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("expected Connect to be a no-op, got %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+				t.Errorf("expected no error, got %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, errs := pc.QueryIPs([]net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("batch query %d: expected no error, got %s", i, err)
+		}
+	}
+
+	// Every query got a connection of its own and the batch shared one.
+	if got := connections.Load(); got != 9 {
+		t.Errorf("expected 9 connections, got %d", got)
+	}
+}
+
+func TestP0fBuildQueryBytes(t *testing.T) {
+	for _, test := range []struct {
+		description  string
+		ip           string
+		mappedAsIPv6 bool
+		expected     []byte
+		err          error
+	}{
+		{
+			description: "ipv4",
+			ip:          "192.0.2.1",
+			expected: []byte{
+				0x01, 0x46, 0x30, 0x50, 0x04,
+				192, 0, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+		},
+		{
+			description: "ipv6",
+			ip:          "2001:db8::1",
+			expected: []byte{
+				0x01, 0x46, 0x30, 0x50, 0x06,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			},
+		},
+		{
+			description:  "mapped as ipv6",
+			ip:           "::ffff:192.0.2.1",
+			mappedAsIPv6: true,
+			expected: []byte{
+				0x01, 0x46, 0x30, 0x50, 0x06,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 0, 2, 1,
+			},
+		},
+		{
+			description: "unspecified",
+			ip:          "0.0.0.0",
+			err:         ErrUnspecifiedIP,
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			pc := NewP0fClient("/tmp/p0f.sock", WithMappedAsIPv6(test.mappedAsIPv6))
+			got, err := pc.BuildQueryBytes(net.ParseIP(test.ip))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+			if !bytes.Equal(got, test.expected) {
+				t.Errorf("expected % x, got % x", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestP0fQueryCustomMagic(t *testing.T) {
+	const reqMagic, respMagic = 0x12345601, 0x12345602
+
+	response := okResponse
+	response.Magic = respMagic
+
+	rw := &bufferPair{}
+	binary.Write(&rw.toRead, binary.LittleEndian, response)
+	binary.Write(&rw.toRead, binary.LittleEndian, okResponse)
+
+	pc := newP0fClientRW(rw)
+	pc.SetMagic(reqMagic, respMagic)
+	resp, err := pc.QueryIP(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if *resp != response {
+		t.Errorf("expected %+v, got %+v", response, *resp)
+	}
+
+	var query Query
+	if err := binary.Read(&rw.written, binary.LittleEndian, &query); err != nil {
+		t.Fatalf("could not decode query: %s", err)
+	}
+	if query.Magic != reqMagic {
+		t.Errorf("expected request magic %#x, got %#x", reqMagic, query.Magic)
+	}
+
+	// The standard response magic is not accepted anymore.
+	if _, err := pc.QueryIP(net.ParseIP("192.0.2.1")); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("expected ErrBadMagic, got %v", err)
+	}
+
+	if req, resp := NewP0fClient("", WithMagic(0, 0)).magics(); req != P0F_REQUEST_MAGIC || resp != P0F_RESPONSE_MAGIC {
+		t.Errorf("expected the standard magic values, got %#x and %#x", req, resp)
+	}
+}
+
+func TestP0fQueryIPRaw(t *testing.T) {
+	expected := okResponse
+	copy(expected.OsName[:], "Linux")
+
+	var wire bytes.Buffer
+	binary.Write(&wire, binary.LittleEndian, expected)
+
+	rw := &bufferPair{}
+	rw.toRead.Write(wire.Bytes())
+	// A second response with a bad magic.
+	rw.toRead.Write([]byte{0x02, 0x46, 0x30, 0x51})
+
+	pc := newP0fClientRW(rw)
+	resp, raw, err := pc.QueryIPRaw(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	if *resp != expected {
+		t.Errorf("expected %+v, got %+v", expected, *resp)
+	}
+
+	if !bytes.Equal(raw, wire.Bytes()) {
+		t.Errorf("expected raw bytes % x, got % x", wire.Bytes(), raw)
+	}
+
+	_, raw, err = pc.QueryIPRaw(net.ParseIP("192.0.2.1"))
+	if !errors.Is(err, ErrBadMagic) {
+		t.Errorf("expected ErrBadMagic, got %v", err)
+	}
+
+	if !bytes.Equal(raw, []byte{0x02, 0x46, 0x30, 0x51}) {
+		t.Errorf("expected the magic bytes, got % x", raw)
+	}
+}
+
+func TestP0fQueryBigEndian(t *testing.T) {
+	rw := &bufferPair{}
+	binary.Write(&rw.toRead, binary.BigEndian, okResponse)
+
+	_, err := newP0fClientRW(rw).QueryIP(net.ParseIP("192.0.2.1"))
+	if !errors.Is(err, ErrBigEndian) || !errors.Is(err, ErrBadMagic) {
+		t.Errorf("expected ErrBigEndian, got %v", err)
+	}
+}
+
+func TestP0fConnectWithRetry(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "p0f.sock")
+
+	// The socket appears only after a while.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Errorf("could not listen: %s", err)
+			return
+		}
+		t.Cleanup(func() { l.Close() })
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go answerQueries(conn, okResponse)
+		}
+	}()
+
+	pc := NewP0fClient(socket)
+	if err := pc.ConnectWithRetry(context.Background(), 10*time.Millisecond, 0); err != nil {
+		t.Fatalf("expected to connect, got %s", err)
+	}
+	defer pc.Stop()
+
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+func TestP0fConnectWithRetryGivesUp(t *testing.T) {
+	pc := NewP0fClient("/tmp/dsddsdsskdldewu89783jjkjjk")
+
+	err := pc.ConnectWithRetry(context.Background(), time.Millisecond, 3)
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) {
+		t.Errorf("expected a ConnectError after the attempts ran out, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = pc.ConnectWithRetry(ctx, time.Millisecond, 0)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &connectErr) {
+		t.Errorf("expected context.DeadlineExceeded and a ConnectError, got %v", err)
+	}
+}
+
+func TestP0fClone(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	pc.SetTimeout(time.Second)
+	pc.SetAutoReconnect(2)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	clone := pc.Clone()
+	if clone.socketFile != socket || clone.timeout != time.Second || clone.maxRetries != 2 {
+		t.Errorf("configuration was not copied: %+v", clone)
+	}
+
+	if _, err := clone.QueryIP(net.ParseIP("127.0.0.1")); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected clone to be disconnected, got %v", err)
+	}
+
+	if err := clone.Connect(); err != nil {
+		t.Fatalf("could not connect clone: %s", err)
+	}
+	defer clone.Stop()
+
+	if _, err := clone.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("unexpected error from clone: %s", err)
+	}
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("unexpected error from original: %s", err)
+	}
+}
+
+func TestP0fSetReadDeadline(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		// Never answer.
+		io.Copy(io.Discard, conn)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	if err := pc.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatalf("could not set read deadline: %s", err)
+	}
+
+	_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+
+	if err := pc.SetReadDeadline(time.Time{}); err != nil {
+		t.Errorf("could not clear read deadline: %s", err)
+	}
+	if !pc.readDeadline.IsZero() {
+		t.Errorf("expected read deadline to be cleared, got %s", pc.readDeadline)
+	}
+}
+
+func TestEarliest(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Second)
+
+	for _, test := range []struct {
+		description string
+		a, b        time.Time
+		expected    time.Time
+	}{
+		{description: "both zero", expected: time.Time{}},
+		{description: "a zero", b: now, expected: now},
+		{description: "b zero", a: now, expected: now},
+		{description: "a earlier", a: now, b: later, expected: now},
+		{description: "b earlier", a: later, b: now, expected: now},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			if got := earliest(test.a, test.b); !got.Equal(test.expected) {
+				t.Errorf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestAddressTypeString(t *testing.T) {
+	for _, test := range []struct {
+		addressType AddressType
+		expected    string
+	}{
+		{addressType: P0F_ADDR_IPV4, expected: "ipv4"},
+		{addressType: P0F_ADDR_IPV6, expected: "ipv6"},
+		{addressType: 5, expected: "unknown"},
+	} {
+		if got := test.addressType.String(); got != test.expected {
+			t.Errorf("address type %d: expected %q, got %q", uint8(test.addressType), test.expected, got)
+		}
+	}
+}
+
+func TestP0fCheckTrailingData(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		for binary.Read(conn, binary.LittleEndian, &query) == nil {
+			// Answer every query twice in a single write.
+			if binary.Write(conn, binary.LittleEndian, []Response{okResponse, okResponse}) != nil {
+				return
+			}
+		}
+	})
+
+	pc := NewP0fClient(socket)
+	pc.SetCheckTrailingData(true)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if !errors.Is(err, ErrTrailingData) {
+		t.Errorf("expected ErrTrailingData, got %v", err)
+	}
+
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestP0fCheckTrailingDataClean(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	pc.SetCheckTrailingData(true)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	for i := 0; i < 3; i++ {
+		if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+	}
+}
+
+func TestP0fQueryIPInto(t *testing.T) {
+	expected := okResponse
+	copy(expected.OsName[:], "Linux")
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, expected)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	var resp Response
+	for i := 0; i < 2; i++ {
+		if err := pc.QueryIPInto(net.ParseIP("127.0.0.1"), &resp); err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if resp.OsNameString() != "Linux" {
+			t.Errorf("expected Linux, got %q", resp.OsNameString())
+		}
+	}
+}
+
+func TestP0fConnectContext(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.ConnectContext(context.Background()); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := pc.ConnectContext(ctx)
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancelled ConnectError, got %v", err)
+	}
+
+	// The failed dial must not have closed the existing connection.
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+// answerOnce answers a single query on conn and then closes it.
+func answerOnce(conn net.Conn) {
+	defer conn.Close()
+
+	var query Query
+	if binary.Read(conn, binary.LittleEndian, &query) == nil {
+		binary.Write(conn, binary.LittleEndian, okResponse)
+	}
+}
+
+func TestP0fConnectionClosed(t *testing.T) {
+	socket := startTestServer(t, answerOnce)
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if !errors.Is(err, ErrConnectionClosed) || !errors.Is(err, ErrSocketCommunication) {
+		t.Errorf("expected ErrConnectionClosed, got %v", err)
+	}
+}
+
+func TestP0fConnectionClosedReconnect(t *testing.T) {
+	socket := startTestServer(t, answerOnce)
+
+	pc := NewP0fClient(socket, WithAutoReconnect(1))
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+			t.Fatalf("query %d: expected no error, got %s", i, err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed >= reconnectBackoff {
+		t.Errorf("expected reconnects without backoff, took %s", elapsed)
+	}
+}
+
+func TestP0fDialFunc(t *testing.T) {
+	var dialed string
+	dial := func(network, addr string) (net.Conn, error) {
+		dialed = network + " " + addr
+		client, server := net.Pipe()
+		go answerQueries(server, okResponse)
+		return client, nil
+	}
+
+	// The socket does not exist; the dial function must be used instead.
+	pc := NewP0fClient("/does/not/exist", WithDialFunc(dial))
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	if dialed != "unix /does/not/exist" {
+		t.Errorf("unexpected dial of %q", dialed)
+	}
+	if _, err := pc.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+func TestP0fDialFuncError(t *testing.T) {
+	dialErr := errors.New("tunnel down")
+	pc := NewP0fClient("/does/not/exist")
+	pc.SetDialFunc(func(network, addr string) (net.Conn, error) {
+		return nil, dialErr
+	})
+
+	err := pc.Connect()
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) || !errors.Is(err, dialErr) {
+		t.Errorf("expected ConnectError wrapping the dial error, got %v", err)
+	}
+}
+
+func TestP0fConcurrentQueryIP(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		for binary.Read(conn, binary.LittleEndian, &query) == nil {
+			// Answer with the queried address so that a mixed up answer is
+			// noticed.
+			resp := okResponse
+			copy(resp.OsName[:], net.IP(query.Address[:4]).String())
+			if binary.Write(conn, binary.LittleEndian, resp) != nil {
+				return
+			}
+		}
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				ip := net.IPv4(10, 0, byte(i), byte(j))
+				resp, err := pc.QueryIP(ip)
+				if err != nil {
+					t.Errorf("query %s: expected no error, got %s", ip, err)
+					return
+				}
+				if got := resp.OsNameString(); got != ip.String() {
+					t.Errorf("query %s: got the answer for %s", ip, got)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestQueryString(t *testing.T) {
+	ipv4, _ := createQueryForIP(net.ParseIP("192.0.2.1"))
+	ipv6, _ := createQueryForIP(net.ParseIP("2001:db8::1"))
+	badMagic := ipv4
+	badMagic.Magic = 1
+
+	for _, test := range []struct {
+		description string
+		query       Query
+		expected    string
+	}{
+		{
+			description: "ipv4",
+			query:       ipv4,
+			expected:    "ipv4 address 192.0.2.1",
+		},
+		{
+			description: "ipv6",
+			query:       ipv6,
+			expected:    "ipv6 address 2001:db8::1",
+		},
+		{
+			description: "unknown address type",
+			query:       Query{Magic: P0F_REQUEST_MAGIC, AddressType: 5},
+			expected:    "address 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 with unknown address type 0x5",
+		},
+		{
+			description: "bad magic",
+			query:       badMagic,
+			expected:    "ipv4 address 192.0.2.1 and bad magic 0x1",
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			if got := test.query.String(); got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestP0fEmptyReads(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		emptyReads  int
+		expectError bool
+	}{
+		{
+			description: "single empty read",
+			emptyReads:  1,
+		},
+		{
+			description: "no progress",
+			emptyReads:  maxEmptyReads,
+			expectError: true,
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			rw := &bufferPair{emptyReads: test.emptyReads}
+			binary.Write(&rw.toRead, binary.LittleEndian, okResponse)
+
+			pc := newP0fClientRW(rw)
+			_, err := pc.QueryIP(net.ParseIP("192.0.2.1"))
+			if !test.expectError {
+				if err != nil {
+					t.Errorf("expected no error, got %s", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrSocketCommunication) || errors.Is(err, ErrBadMagic) {
+				t.Errorf("expected ErrSocketCommunication, got %v", err)
+			}
+		})
+	}
+}
+
+func TestP0fWriteBrokenPipe(t *testing.T) {
+	closed := make(chan struct{})
+	socket := startTestServer(t, func(conn net.Conn) {
+		conn.Close()
+		close(closed)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+	<-closed
+
+	_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("expected ErrConnectionClosed, got %v", err)
+	}
+}
+
+func TestP0fWriteClosedConn(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+
+	// Close the connection behind the back of the client.
+	pc.connection.(net.Conn).Close()
+
+	_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("expected ErrConnectionClosed, got %v", err)
+	}
+}
+
+func TestP0fLogger(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	pc := NewP0fClient(socket, WithLogger(logger))
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+
+	if _, err := pc.QueryIP(net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if _, errs := pc.QueryIPsPipelined([]net.IP{net.ParseIP("192.0.2.3")}); errs[0] != nil {
+		t.Fatalf("expected no error, got %s", errs[0])
+	}
+
+	pc.Stop()
+	if _, err := pc.QueryIP(net.ParseIP("192.0.2.2")); err == nil {
+		t.Fatalf("expected an error after Stop")
+	}
+
+	for _, expected := range []string{
+		`level=DEBUG msg="connecting to p0f" network=unix`,
+		`level=DEBUG msg="p0f query"`,
+		`ip=192.0.2.1 status=ok`,
+		`ip=192.0.2.3 status=ok`,
+		`level=WARN msg="p0f query failed"`,
+		`ip=192.0.2.2 error="client not connected`,
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("expected %q in the logs:\n%s", expected, logs.String())
+		}
+	}
+}
+
+func TestP0fCancelOngoing(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		// Never answer.
+		io.Copy(io.Discard, conn)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	if pc.CancelOngoing() {
+		t.Errorf("expected nothing to cancel")
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+		done <- err
+	}()
+
+	// The query may not have started yet.
+	deadline := time.Now().Add(time.Second)
+	for !pc.CancelOngoing() {
+		if time.Now().After(deadline) {
+			t.Fatalf("query did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrQueryCanceled) {
+			t.Errorf("expected ErrQueryCanceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("query was not canceled")
+	}
+
+	if pc.IsConnected() {
+		t.Errorf("expected the connection to be closed")
+	}
+}
+
+func TestP0fQueryUnspecified(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	for _, ip := range []string{"0.0.0.0", "::"} {
+		if _, err := pc.QueryIP(net.ParseIP(ip)); !errors.Is(err, ErrUnspecifiedIP) {
+			t.Errorf("%s: expected ErrUnspecifiedIP, got %v", ip, err)
+		}
+	}
+
+	_, errs := pc.QueryIPs([]net.IP{net.IPv6unspecified})
+	if !errors.Is(errs[0], ErrUnspecifiedIP) {
+		t.Errorf("expected ErrUnspecifiedIP from QueryIPs, got %v", errs[0])
+	}
+
+	// Ping queries 0.0.0.0 on purpose.
+	if err := pc.Ping(); err != nil {
+		t.Errorf("expected ping to work, got %s", err)
+	}
+
+	pc.SetAllowUnspecified(true)
+	for _, ip := range []string{"0.0.0.0", "::"} {
+		if _, err := pc.QueryIP(net.ParseIP(ip)); err != nil {
+			t.Errorf("%s: expected no error when allowed, got %s", ip, err)
+		}
+	}
+}
+
+func TestP0fBufferPool(t *testing.T) {
+	expected := okResponse
+	copy(expected.OsName[:], "Linux")
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, expected)
+	})
+
+	pc := NewP0fClient(socket, WithBufferPool(true))
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	for i := 0; i < 3; i++ {
+		resp, err := pc.QueryIP(net.ParseIP("127.0.0.1"))
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if resp.OsNameString() != "Linux" {
+			t.Errorf("expected Linux, got %q", resp.OsNameString())
+		}
+	}
+
+	if pc.readbuf != nil {
+		t.Errorf("expected no buffer per client with the buffer pool")
+	}
+}
+
+func TestP0fQueryIPTimed(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		for binary.Read(conn, binary.LittleEndian, &query) == nil {
+			time.Sleep(20 * time.Millisecond)
+			if binary.Write(conn, binary.LittleEndian, okResponse) != nil {
+				return
+			}
+		}
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	resp, d, err := pc.QueryIPTimed(net.ParseIP("127.0.0.1"))
+	if err != nil || resp == nil {
+		t.Fatalf("expected a response, got %v", err)
+	}
+	if d < 20*time.Millisecond || d > time.Second {
+		t.Errorf("expected a duration of about 20ms, got %s", d)
+	}
+}
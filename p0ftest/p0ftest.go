@@ -0,0 +1,102 @@
+// Package p0ftest provides a mock p0f server for testing code that uses
+// p0fclient without a running p0f daemon.
+package p0ftest
+
+import (
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mrheinen/p0fclient"
+)
+
+// NewMockServer starts a server that listens on a temporary unix socket and
+// answers p0f queries. It returns the path of the socket and a function to
+// set the response that is sent for the following queries. Until a response
+// is set, queries are answered with P0F_STATUS_NOMATCH. The magic of the
+// response is filled in if it is left zero. Malformed queries are answered
+// with P0F_STATUS_BADQUERY, like p0f does.
+//
+// The server is shut down when the test finishes.
+func NewMockServer(t testing.TB) (socketPath string, control func(*p0fclient.Response)) {
+	t.Helper()
+
+	socketPath = filepath.Join(t.TempDir(), "p0f.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("could not listen on %s: %s", socketPath, err)
+	}
+
+	var mu sync.Mutex
+	response := p0fclient.Response{Status: p0fclient.P0F_STATUS_NOMATCH}
+	control = func(resp *p0fclient.Response) {
+		mu.Lock()
+		defer mu.Unlock()
+		response = *resp
+	}
+
+	var wg sync.WaitGroup
+	conns := make(map[net.Conn]struct{})
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			conns[conn] = struct{}{}
+			mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+
+				var query p0fclient.Query
+				for binary.Read(conn, binary.LittleEndian, &query) == nil {
+					mu.Lock()
+					resp := response
+					mu.Unlock()
+
+					if !validQuery(query) {
+						resp = p0fclient.Response{Status: p0fclient.P0F_STATUS_BADQUERY}
+					}
+					if resp.Magic == 0 {
+						resp.Magic = p0fclient.P0F_RESPONSE_MAGIC
+					}
+
+					if binary.Write(conn, binary.LittleEndian, resp) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return socketPath, control
+}
+
+// validQuery returns true if p0f would accept the query.
+func validQuery(query p0fclient.Query) bool {
+	if query.Magic != p0fclient.P0F_REQUEST_MAGIC {
+		return false
+	}
+
+	return query.AddressType == p0fclient.P0F_ADDR_IPV4 ||
+		query.AddressType == p0fclient.P0F_ADDR_IPV6
+}
@@ -0,0 +1,71 @@
+package p0ftest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mrheinen/p0fclient"
+)
+
+func TestNewMockServer(t *testing.T) {
+	socket, control := NewMockServer(t)
+
+	pc := p0fclient.NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	resp, err := pc.QueryIP(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	if resp.Status != p0fclient.P0F_STATUS_NOMATCH {
+		t.Errorf("expected no match by default, got %s", resp.StatusString())
+	}
+
+	match := &p0fclient.Response{Status: p0fclient.P0F_STATUS_OK}
+	copy(match.OsName[:], "Linux")
+	control(match)
+
+	resp, err = pc.QueryIP(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	if got := resp.OsNameString(); got != "Linux" {
+		t.Errorf("expected OS Linux, got %q", got)
+	}
+}
+
+func TestValidQuery(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		query       p0fclient.Query
+		expected    bool
+	}{
+		{
+			description: "ipv4",
+			query:       p0fclient.Query{Magic: p0fclient.P0F_REQUEST_MAGIC, AddressType: p0fclient.P0F_ADDR_IPV4},
+			expected:    true,
+		},
+		{
+			description: "bad magic",
+			query:       p0fclient.Query{Magic: 1, AddressType: p0fclient.P0F_ADDR_IPV4},
+			expected:    false,
+		},
+		{
+			description: "bad address type",
+			query:       p0fclient.Query{Magic: p0fclient.P0F_REQUEST_MAGIC, AddressType: 5},
+			expected:    false,
+		},
+	} {
+
+		t.Run(test.description, func(t *testing.T) {
+			if got := validQuery(test.query); got != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, got)
+			}
+		})
+	}
+}
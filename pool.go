@@ -0,0 +1,118 @@
+package p0fclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// P0fPool manages a number of independent connections to the same p0f
+// socket. Every query uses a connection that is not in use by another query
+// so that concurrent callers do not have to wait for each other.
+type P0fPool struct {
+	clients []*P0fClient
+	// idle holds the clients that are not in use by a query.
+	idle chan *P0fClient
+
+	// mu serializes Connect and Close. connected is set while the
+	// connections are open.
+	mu        sync.Mutex
+	connected atomic.Bool
+}
+
+// NewP0fPool returns a new pool of size connections to the given socket.
+// The options are applied to every connection. Remember to call Connect()
+// before doing any queries. A pool with a size below 1 has no connections
+// and fails to connect.
+func NewP0fPool(socketFile string, size int, opts ...Option) *P0fPool {
+	size = max(size, 0)
+	pool := &P0fPool{
+		idle: make(chan *P0fClient, size),
+	}
+
+	for i := 0; i < size; i++ {
+		client := NewP0fClient(socketFile, opts...)
+		pool.clients = append(pool.clients, client)
+		pool.idle <- client
+	}
+
+	return pool
+}
+
+// Connect opens all connections of the pool. If one of the connections
+// cannot be opened then the already opened connections are closed again.
+// Calling Connect on a pool that is connected does nothing.
+func (p *P0fPool) Connect() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.clients) == 0 {
+		return fmt.Errorf("pool has no connections")
+	}
+	if p.connected.Load() {
+		return nil
+	}
+
+	for i, client := range p.clients {
+		if err := client.Connect(); err != nil {
+			for _, c := range p.clients[:i] {
+				c.Stop()
+			}
+			return fmt.Errorf("connection %d: %w", i, err)
+		}
+	}
+
+	p.connected.Store(true)
+	return nil
+}
+
+// QueryIP queries p0f for the IP address using an idle connection of the
+// pool. If all connections are in use then QueryIP waits until one becomes
+// idle. ErrNotConnected is returned if the pool is not connected. See
+// P0fClient.QueryIP for a description of the result.
+func (p *P0fPool) QueryIP(ip net.IP) (*Response, error) {
+	return p.QueryIPContext(context.Background(), ip)
+}
+
+// QueryIPContext is like QueryIP but stops waiting for an idle connection
+// when the context is done, in which case the error of the context is
+// returned. This bounds how long a query can take when the pool is
+// saturated. The context is passed on to the query; see
+// P0fClient.QueryIPContext.
+func (p *P0fPool) QueryIPContext(ctx context.Context, ip net.IP) (*Response, error) {
+	if !p.connected.Load() {
+		return nil, ErrNotConnected
+	}
+
+	var client *P0fClient
+	select {
+	case client = <-p.idle:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { p.idle <- client }()
+
+	return client.QueryIPContext(ctx, ip)
+}
+
+// P0fPool implements Querier.
+var _ Querier = (*P0fPool)(nil)
+
+// Close closes all connections of the pool. The pool can be connected again
+// with Connect.
+func (p *P0fPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.connected.Store(false)
+	var firstErr error
+	for _, client := range p.clients {
+		if err := client.Stop(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,129 @@
+package p0fclient
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestP0fPoolQueryIP(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pool := NewP0fPool(socket, 4)
+	if err := pool.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pool.QueryIP(net.ParseIP("127.0.0.1")); err != nil {
+				t.Errorf("expected no error, got %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestP0fPoolQueryIPContextSaturated(t *testing.T) {
+	release := make(chan struct{})
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		for binary.Read(conn, binary.LittleEndian, &query) == nil {
+			<-release
+			if binary.Write(conn, binary.LittleEndian, okResponse) != nil {
+				return
+			}
+		}
+	})
+
+	pool := NewP0fPool(socket, 1)
+	if err := pool.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pool.Close()
+
+	// Keep the only connection busy.
+	busy := make(chan error, 1)
+	go func() {
+		_, err := pool.QueryIP(net.ParseIP("192.0.2.1"))
+		busy <- err
+	}()
+	for len(pool.idle) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.QueryIPContext(ctx, net.ParseIP("192.0.2.2")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	close(release)
+	if err := <-busy; err != nil {
+		t.Errorf("expected no error for the busy query, got %s", err)
+	}
+	if _, err := pool.QueryIPContext(context.Background(), net.ParseIP("192.0.2.2")); err != nil {
+		t.Errorf("expected no error once the connection is idle, got %s", err)
+	}
+}
+
+func TestP0fPoolNotConnected(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pool := NewP0fPool(socket, 2)
+	if _, err := pool.QueryIP(net.ParseIP("192.0.2.1")); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("before Connect: expected ErrNotConnected, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := pool.Connect(); err != nil {
+			t.Fatalf("connect %d: could not connect: %s", i+1, err)
+		}
+	}
+	if _, err := pool.QueryIP(net.ParseIP("192.0.2.1")); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+
+	if err := pool.Close(); err != nil {
+		t.Fatalf("could not close: %s", err)
+	}
+	if _, err := pool.QueryIP(net.ParseIP("192.0.2.1")); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("after Close: expected ErrNotConnected, got %v", err)
+	}
+
+	if err := pool.Connect(); err != nil {
+		t.Fatalf("could not connect again: %s", err)
+	}
+	defer pool.Close()
+	if _, err := pool.QueryIP(net.ParseIP("192.0.2.1")); err != nil {
+		t.Errorf("after reconnecting: expected no error, got %s", err)
+	}
+}
+
+func TestP0fPoolConnectError(t *testing.T) {
+	pool := NewP0fPool("/tmp/dsddsdsskdldewu89783jjkjjk", 2)
+	if err := pool.Connect(); err == nil {
+		t.Errorf("expected an error connecting to a missing socket")
+	}
+
+	if err := NewP0fPool("/tmp/dsddsdsskdldewu89783jjkjjk", 0).Connect(); err == nil {
+		t.Errorf("expected an error for an empty pool")
+	}
+	if err := NewP0fPool("/tmp/dsddsdsskdldewu89783jjkjjk", -1).Connect(); err == nil {
+		t.Errorf("expected an error for a negative size")
+	}
+}
@@ -0,0 +1,22 @@
+package p0fclient
+
+import (
+	"context"
+	"net"
+)
+
+// Querier is the query interface of P0fClient. Code that queries p0f can
+// depend on it instead of on *P0fClient so that tests can pass in a fake.
+// The constructors still return the concrete types.
+type Querier interface {
+	// QueryIP queries p0f for the IP address; see P0fClient.QueryIP.
+	QueryIP(ip net.IP) (*Response, error)
+	// QueryIPContext is like QueryIP but can be cancelled through the
+	// context; see P0fClient.QueryIPContext.
+	QueryIPContext(ctx context.Context, ip net.IP) (*Response, error)
+	// Close closes the connection to p0f.
+	Close() error
+}
+
+// P0fClient implements Querier.
+var _ Querier = (*P0fClient)(nil)
@@ -0,0 +1,626 @@
+package p0fclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// cString converts a NUL padded p0f string field into a Go string. The
+// string ends at the first NUL byte.
+func cString(b []uint8) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// OsNameString returns the OsName field as a string.
+func (r *Response) OsNameString() string {
+	return cString(r.OsName[:])
+}
+
+// OsFlavorString returns the OsFlavor field as a string.
+func (r *Response) OsFlavorString() string {
+	return cString(r.OsFlavor[:])
+}
+
+// HttpNameString returns the HttpName field as a string.
+func (r *Response) HttpNameString() string {
+	return cString(r.HttpName[:])
+}
+
+// HttpFlavorString returns the HttpFlavor field as a string.
+func (r *Response) HttpFlavorString() string {
+	return cString(r.HttpFlavor[:])
+}
+
+// LinkTypeString returns the LinkType field as a string.
+func (r *Response) LinkTypeString() string {
+	return cString(r.LinkType[:])
+}
+
+// LanguageString returns the Language field as a string.
+func (r *Response) LanguageString() string {
+	return cString(r.Language[:])
+}
+
+// unixTime converts a p0f timestamp into a time.Time. A zero timestamp means
+// the event never happened and is returned as the zero time.Time.
+func unixTime(ts uint32) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(ts), 0)
+}
+
+// FirstSeenTime returns the time the host was first seen by p0f.
+func (r *Response) FirstSeenTime() time.Time {
+	return unixTime(r.FirstSeen)
+}
+
+// LastSeenTime returns the time the host was last seen by p0f.
+func (r *Response) LastSeenTime() time.Time {
+	return unixTime(r.LastSeen)
+}
+
+// SeenDuration returns how long p0f has been observing the host, the time
+// between FirstSeen and LastSeen. A long duration suggests a long-lived host
+// while a short one is typical for ephemeral hosts such as scanners. It is 0
+// if either time is missing or LastSeen is before FirstSeen.
+func (r *Response) SeenDuration() time.Duration {
+	if r.FirstSeen == 0 || r.LastSeen <= r.FirstSeen {
+		return 0
+	}
+	return time.Duration(r.LastSeen-r.FirstSeen) * time.Second
+}
+
+// LastNatTime returns the time p0f last detected the host being behind NAT.
+// The zero time.Time is returned if this was never detected.
+func (r *Response) LastNatTime() time.Time {
+	return unixTime(r.LastNat)
+}
+
+// BehindNAT returns true if p0f ever detected that the host is behind NAT or
+// a proxy. LastNatTime tells when this was last detected.
+func (r *Response) BehindNAT() bool {
+	return r.LastNat != 0
+}
+
+// LastChgTime returns the time p0f last saw a change in the signature of the
+// host. The zero time.Time is returned if no change was ever seen.
+func (r *Response) LastChgTime() time.Time {
+	return unixTime(r.LastChg)
+}
+
+// Observations returns how many connections of the host p0f saw, the
+// TotalCount field. A fingerprint based on few observations is less
+// reliable than one seen many times. The counter is a uint32 in p0f and
+// wraps around to 0 after 4294967295 connections, so a long-lived, very busy
+// host can show a low count.
+func (r *Response) Observations() uint32 {
+	return r.TotalCount
+}
+
+// ChangedSince returns true if p0f saw the signature of the host change
+// after t, for example because of an OS upgrade or because another host
+// took over the address. A host whose signature never changed returns false.
+func (r *Response) ChangedSince(t time.Time) bool {
+	return r.LastChg != 0 && r.LastChgTime().After(t)
+}
+
+// LinkClass is a coarse classification of the network link of a host.
+type LinkClass string
+
+const (
+	LinkEthernet LinkClass = "ethernet"
+	LinkDSL      LinkClass = "dsl"
+	LinkPPPoE    LinkClass = "pppoe"
+	LinkGPRS     LinkClass = "gprs"
+	LinkUnknown  LinkClass = "unknown"
+)
+
+// LinkClass buckets the link type p0f derived from the MTU into a LinkClass.
+// Link types p0f reports that do not fit in one of the classes, such as
+// tunnels and VPNs, return LinkUnknown.
+func (r *Response) LinkClass() LinkClass {
+	link := strings.ToLower(r.LinkTypeString())
+	switch {
+	case strings.HasPrefix(link, "ethernet"):
+		return LinkEthernet
+	case strings.HasPrefix(link, "pppoe"):
+		return LinkPPPoE
+	case strings.HasPrefix(link, "dsl"):
+		return LinkDSL
+	case strings.HasPrefix(link, "gprs"):
+		return LinkGPRS
+	default:
+		return LinkUnknown
+	}
+}
+
+// OSFamilyPrefix maps the OS names that start with Prefix to Family.
+type OSFamilyPrefix struct {
+	Prefix string
+	Family string
+}
+
+// OSFamilies is the table OSFamily uses to map OS names to families. The
+// first entry whose prefix matches wins, so entries for a custom p0f
+// database can be prepended to it. Change it before any concurrent calls to
+// OSFamily.
+var OSFamilies = []OSFamilyPrefix{
+	{Prefix: "Linux", Family: "linux"},
+	{Prefix: "Android", Family: "linux"},
+	{Prefix: "Windows", Family: "windows"},
+	{Prefix: "Mac OS", Family: "macos"},
+	{Prefix: "FreeBSD", Family: "bsd"},
+	{Prefix: "OpenBSD", Family: "bsd"},
+	{Prefix: "NetBSD", Family: "bsd"},
+	{Prefix: "DragonFly", Family: "bsd"},
+}
+
+// OSFamily returns the family of the OS, such as "linux", "windows",
+// "macos" or "bsd", by looking up the OS name in OSFamilies. The lookup
+// ignores case. An OS that is not in the table returns "other".
+func (r *Response) OSFamily() string {
+	name := strings.ToLower(r.OsNameString())
+	for _, f := range OSFamilies {
+		if strings.HasPrefix(name, strings.ToLower(f.Prefix)) {
+			return f.Family
+		}
+	}
+	return "other"
+}
+
+// languageTags maps the language names p0f reports to BCP-47 tags.
+var languageTags = map[string]string{
+	"arabic":     "ar",
+	"chinese":    "zh",
+	"czech":      "cs",
+	"danish":     "da",
+	"dutch":      "nl",
+	"english":    "en",
+	"finnish":    "fi",
+	"french":     "fr",
+	"german":     "de",
+	"greek":      "el",
+	"hebrew":     "he",
+	"hungarian":  "hu",
+	"italian":    "it",
+	"japanese":   "ja",
+	"korean":     "ko",
+	"norwegian":  "no",
+	"polish":     "pl",
+	"portuguese": "pt",
+	"romanian":   "ro",
+	"russian":    "ru",
+	"spanish":    "es",
+	"swedish":    "sv",
+	"turkish":    "tr",
+	"ukrainian":  "uk",
+}
+
+// LanguageTag returns the language of the host as a BCP-47 tag such as "en"
+// or "pt-BR". Language names like "English" are mapped to their tag and
+// values that already look like a tag are normalized. The boolean is false
+// if the language is empty or unknown.
+func (r *Response) LanguageTag() (string, bool) {
+	lang := strings.TrimSpace(r.LanguageString())
+	if tag, ok := languageTags[strings.ToLower(lang)]; ok {
+		return tag, true
+	}
+
+	primary, region, hasRegion := strings.Cut(strings.ReplaceAll(lang, "_", "-"), "-")
+	if len(primary) < 2 || len(primary) > 3 || !isLetters(primary) {
+		return "", false
+	}
+
+	if !hasRegion {
+		return strings.ToLower(primary), true
+	}
+	if len(region) != 2 || !isLetters(region) {
+		return "", false
+	}
+	return strings.ToLower(primary) + "-" + strings.ToUpper(region), true
+}
+
+// isLetters returns true if s only consists of ASCII letters.
+func isLetters(s string) bool {
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// Uptime returns the uptime of the host as calculated by p0f from TCP
+// timestamps. The boolean is false if p0f has no uptime data for the host.
+// Note that the uptime wraps around; see UptimeWrap.
+func (r *Response) Uptime() (time.Duration, bool) {
+	if r.UptimeMinutes == 0 {
+		return 0, false
+	}
+	return time.Duration(r.UptimeMinutes) * time.Minute, true
+}
+
+// UptimeString returns the uptime of the host formatted as days, hours and
+// minutes, for example "3d 4h 12m". Leading units that are zero are left
+// out, so an uptime of 90 minutes is "1h 30m". It returns "unknown" if p0f
+// has no uptime data for the host.
+func (r *Response) UptimeString() string {
+	if _, ok := r.Uptime(); !ok {
+		return "unknown"
+	}
+
+	days, hours, minutes := r.UptimeMinutes/(24*60), r.UptimeMinutes/60%24, r.UptimeMinutes%60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
+
+// UptimeWrap returns the interval after which the uptime reported by the host
+// wraps around. The actual uptime of the host is the value returned by Uptime
+// plus an unknown multiple of this interval.
+func (r *Response) UptimeWrap() time.Duration {
+	return time.Duration(r.UpModDays) * 24 * time.Hour
+}
+
+// StatusString returns the status of the response as a string; see
+// Status.String.
+func (r *Response) StatusString() string {
+	return r.Status.String()
+}
+
+// IsMatch returns true if p0f found a match for the queried address.
+func (r *Response) IsMatch() bool {
+	return r.Status == P0F_STATUS_OK
+}
+
+// SameFingerprint returns true if both responses describe the same
+// fingerprint: the OS, the HTTP software and the link type are equal. Counters
+// and timestamps, which change every time p0f sees the host, are ignored. A
+// nil response never has the same fingerprint.
+func (r *Response) SameFingerprint(other *Response) bool {
+	if r == nil || other == nil {
+		return false
+	}
+	return r.OsNameString() == other.OsNameString() &&
+		r.OsFlavorString() == other.OsFlavorString() &&
+		r.HttpNameString() == other.HttpNameString() &&
+		r.HttpFlavorString() == other.HttpFlavorString() &&
+		r.LinkTypeString() == other.LinkTypeString()
+}
+
+// maxHopDistance is the largest distance p0f can derive from the TTL of a
+// packet.
+const maxHopDistance = 255
+
+// HopDistance returns the estimated number of network hops between p0f and
+// the host. The boolean is false if p0f could not estimate the distance, in
+// which case the Distance field holds -1, or if the distance is negative or
+// larger than 255. Those values cannot come from a TTL and point at a
+// corrupt response.
+func (r *Response) HopDistance() (int, bool) {
+	if r.Distance < 0 || r.Distance > maxHopDistance {
+		return 0, false
+	}
+	return int(r.Distance), true
+}
+
+// SoftwareMismatch tells whether the software reported by the host, such as
+// the HTTP User-Agent, disagrees with the fingerprinted OS. It returns
+// "none", "likely" or "definite", following the BadSw field, or "unknown"
+// for a value not defined by p0f.
+func (r *Response) SoftwareMismatch() string {
+	switch r.BadSw {
+	case 0:
+		return "none"
+	case 1:
+		return "likely"
+	case 2:
+		return "definite"
+	default:
+		return "unknown"
+	}
+}
+
+// joinNonEmpty joins the non-empty strings with a space.
+func joinNonEmpty(parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, " ")
+}
+
+// Detailed returns all populated fields of the response on a single line as
+// key=value pairs, for example:
+//
+//	os="Linux 3.11 and newer" quality=exact http="Firefox 10.x or newer" link="Ethernet or modem" distance=12 count=3
+//
+// Fields that p0f did not fill in are left out.
+func (r *Response) Detailed() string {
+	var fields []string
+	add := func(key, value string) {
+		if value != "" {
+			fields = append(fields, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+	quote := func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return fmt.Sprintf("%q", value)
+	}
+
+	os := joinNonEmpty(r.OsNameString(), r.OsFlavorString())
+	add("os", quote(os))
+	if os != "" {
+		add("quality", matchQuality(r.OsMatchQ))
+	}
+	add("http", quote(joinNonEmpty(r.HttpNameString(), r.HttpFlavorString())))
+	add("link", quote(r.LinkTypeString()))
+	add("lang", quote(r.LanguageString()))
+	if d, ok := r.HopDistance(); ok {
+		add("distance", fmt.Sprint(d))
+	}
+	if uptime, ok := r.Uptime(); ok {
+		add("uptime", uptime.String())
+	}
+	if r.BadSw != 0 {
+		add("mismatch", r.SoftwareMismatch())
+	}
+	if n := r.Observations(); n != 0 {
+		add("count", fmt.Sprint(n))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// Verbose returns the same as String followed by how often and over what
+// period p0f saw the host, for example:
+//
+//	Linux 3.11 and newer (fuzzy), seen 3 times between 2023-11-14T22:13:20Z and 2023-11-14T22:23:20Z
+//
+// The period is left out if p0f did not record it.
+func (r *Response) Verbose() string {
+	ret := r.String()
+	if n := r.Observations(); n != 0 {
+		ret += fmt.Sprintf(", seen %d times", n)
+	}
+
+	first, last := jsonTime(r.FirstSeen), jsonTime(r.LastSeen)
+	switch {
+	case first != "" && last != "":
+		ret += fmt.Sprintf(" between %s and %s", first, last)
+	case first != "":
+		ret += fmt.Sprintf(" since %s", first)
+	case last != "":
+		ret += fmt.Sprintf(" until %s", last)
+	}
+
+	return ret
+}
+
+// Table returns the populated fields of the response as a two-column table
+// with one field per line and the values aligned, for example:
+//
+//	status      ok
+//	os          Linux 3.11 and newer
+//	quality     fuzzy
+//	distance    12
+//	first seen  2023-11-14T22:13:20Z
+//
+// Times are in UTC. Fields that p0f did not fill in are left out, except for
+// the status.
+func (r *Response) Table() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	add := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%s\t%s\n", key, value)
+		}
+	}
+
+	add("status", r.StatusString())
+	os := joinNonEmpty(r.OsNameString(), r.OsFlavorString())
+	add("os", os)
+	if os != "" {
+		add("quality", matchQuality(r.OsMatchQ))
+	}
+	add("http", joinNonEmpty(r.HttpNameString(), r.HttpFlavorString()))
+	add("link", r.LinkTypeString())
+	add("language", r.LanguageString())
+	if d, ok := r.HopDistance(); ok {
+		add("distance", fmt.Sprint(d))
+	}
+	if _, ok := r.Uptime(); ok {
+		add("uptime", r.UptimeString())
+		if r.UpModDays != 0 {
+			add("uptime wrap", fmt.Sprintf("%d days", r.UpModDays))
+		}
+	}
+	if r.BadSw != 0 {
+		add("mismatch", r.SoftwareMismatch())
+	}
+	if n := r.Observations(); n != 0 {
+		add("observations", fmt.Sprint(n))
+	}
+	add("first seen", jsonTime(r.FirstSeen))
+	add("last seen", jsonTime(r.LastSeen))
+	add("last NAT", jsonTime(r.LastNat))
+	add("last change", jsonTime(r.LastChg))
+
+	w.Flush()
+	return b.String()
+}
+
+// responseJSON is the JSON representation of a Response.
+type responseJSON struct {
+	Status        string `json:"status"`
+	FirstSeen     string `json:"first_seen,omitempty"`
+	LastSeen      string `json:"last_seen,omitempty"`
+	TotalCount    uint32 `json:"total_count"`
+	UptimeMinutes uint32 `json:"uptime_minutes"`
+	UpModDays     uint32 `json:"up_mod_days"`
+	LastNat       string `json:"last_nat,omitempty"`
+	LastChg       string `json:"last_chg,omitempty"`
+	Distance      int16  `json:"distance"`
+	BadSw         uint8  `json:"bad_sw"`
+	MatchQuality  string `json:"match_quality"`
+	OsName        string `json:"os_name"`
+	OsFlavor      string `json:"os_flavor"`
+	HttpName      string `json:"http_name"`
+	HttpFlavor    string `json:"http_flavor"`
+	LinkType      string `json:"link_type"`
+	Language      string `json:"language"`
+}
+
+// MatchQuality describes how well the OS signature matched. OsMatchQ is a
+// bitmask: P0F_MATCH_FUZZY is set when the signature did not match exactly
+// and P0F_MATCH_GENERIC when it matched a generic signature. When neither is
+// set the match is exact and "exact" is returned; otherwise "fuzzy",
+// "generic" or, when both are set, "fuzzy,generic".
+func (r *Response) MatchQuality() string {
+	return matchQuality(r.OsMatchQ)
+}
+
+// matchFlags returns the names of the flags set in the OsMatchQ bitmask,
+// or "exact" if none is set.
+func matchFlags(q uint8) []string {
+	var flags []string
+	if q&P0F_MATCH_FUZZY != 0 {
+		flags = append(flags, "fuzzy")
+	}
+	if q&P0F_MATCH_GENERIC != 0 {
+		flags = append(flags, "generic")
+	}
+
+	if len(flags) == 0 {
+		return []string{"exact"}
+	}
+	return flags
+}
+
+// matchQuality describes the OsMatchQ bitmask. Both the fuzzy and the
+// generic bit can be set; an exact match has neither.
+func matchQuality(q uint8) string {
+	return strings.Join(matchFlags(q), ",")
+}
+
+// jsonMatchQuality describes the OsMatchQ bitmask with a single value for
+// MarshalJSON. A fuzzy match is the weaker one, so it wins when both bits
+// are set.
+func jsonMatchQuality(q uint8) string {
+	switch {
+	case q&P0F_MATCH_FUZZY != 0:
+		return "fuzzy"
+	case q&P0F_MATCH_GENERIC != 0:
+		return "generic"
+	default:
+		return "none"
+	}
+}
+
+// Confidence returns a heuristic score from 0 to 100 for how much the OS
+// fingerprint can be trusted, for ranking hosts during triage. A response
+// without a match scores 0. Otherwise the score starts at 100 and is lowered
+// by:
+//
+//	30 if the signature matched fuzzily (P0F_MATCH_FUZZY)
+//	20 if the signature is generic (P0F_MATCH_GENERIC)
+//	20 if the software likely mismatches the OS (BadSw 1)
+//	40 if the software definitely mismatches the OS (BadSw 2)
+//	20 if p0f saw the host at most once, 10 if fewer than 5 times
+//
+// The score never drops below 0.
+func (r *Response) Confidence() int {
+	if !r.IsMatch() {
+		return 0
+	}
+
+	score := 100
+	if r.OsMatchQ&P0F_MATCH_FUZZY != 0 {
+		score -= 30
+	}
+	if r.OsMatchQ&P0F_MATCH_GENERIC != 0 {
+		score -= 20
+	}
+
+	switch r.BadSw {
+	case 1:
+		score -= 20
+	case 2:
+		score -= 40
+	}
+
+	switch {
+	case r.Observations() <= 1:
+		score -= 20
+	case r.Observations() < 5:
+		score -= 10
+	}
+
+	return max(score, 0)
+}
+
+// jsonTime formats a p0f timestamp as RFC3339 in UTC. Zero timestamps are
+// returned as an empty string so they are left out of the JSON output.
+func jsonTime(ts uint32) string {
+	if ts == 0 {
+		return ""
+	}
+	return unixTime(ts).UTC().Format(time.RFC3339)
+}
+
+// MarshalJSON implements json.Marshaler. The output is an object with the
+// following keys:
+//
+//	status          "ok", "nomatch", "badquery" or "unknown"
+//	first_seen      RFC3339 time in UTC, omitted if never
+//	last_seen       RFC3339 time in UTC, omitted if never
+//	total_count     number of connections seen
+//	uptime_minutes  uptime in minutes, 0 if unknown
+//	up_mod_days     uptime wrap-around interval in days
+//	last_nat        RFC3339 time in UTC, omitted if never
+//	last_chg        RFC3339 time in UTC, omitted if never
+//	distance        network distance in hops, -1 if unknown
+//	bad_sw          software mismatch indicator
+//	match_quality   "fuzzy" when the fuzzy flag is set, also together with
+//	                the generic flag, "generic" when only the generic flag
+//	                is set and "none" for an exact match
+//	os_name, os_flavor, http_name, http_flavor, link_type, language
+//	                the p0f strings with the NUL padding removed
+func (r *Response) MarshalJSON() ([]byte, error) {
+	return json.Marshal(responseJSON{
+		Status:        r.StatusString(),
+		FirstSeen:     jsonTime(r.FirstSeen),
+		LastSeen:      jsonTime(r.LastSeen),
+		TotalCount:    r.TotalCount,
+		UptimeMinutes: r.UptimeMinutes,
+		UpModDays:     r.UpModDays,
+		LastNat:       jsonTime(r.LastNat),
+		LastChg:       jsonTime(r.LastChg),
+		Distance:      r.Distance,
+		BadSw:         r.BadSw,
+		MatchQuality:  jsonMatchQuality(r.OsMatchQ),
+		OsName:        r.OsNameString(),
+		OsFlavor:      r.OsFlavorString(),
+		HttpName:      r.HttpNameString(),
+		HttpFlavor:    r.HttpFlavorString(),
+		LinkType:      r.LinkTypeString(),
+		Language:      r.LanguageString(),
+	})
+}
@@ -0,0 +1,706 @@
+package p0fclient
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseStrings(t *testing.T) {
+	resp := &Response{}
+	copy(resp.OsName[:], "Linux")
+	copy(resp.OsFlavor[:], "2.2.x-3.x")
+	copy(resp.HttpName[:], "Firefox")
+	copy(resp.LinkType[:], "Ethernet or modem")
+
+	for _, test := range []struct {
+		description string
+		got         string
+		expected    string
+	}{
+		{
+			description: "os name",
+			got:         resp.OsNameString(),
+			expected:    "Linux",
+		},
+		{
+			description: "os flavor",
+			got:         resp.OsFlavorString(),
+			expected:    "2.2.x-3.x",
+		},
+		{
+			description: "http name",
+			got:         resp.HttpNameString(),
+			expected:    "Firefox",
+		},
+		{
+			description: "empty http flavor",
+			got:         resp.HttpFlavorString(),
+			expected:    "",
+		},
+		{
+			description: "link type",
+			got:         resp.LinkTypeString(),
+			expected:    "Ethernet or modem",
+		},
+	} {
+
+		t.Run(test.description, func(t *testing.T) {
+			if test.got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, test.got)
+			}
+		})
+	}
+}
+
+func TestCString(t *testing.T) {
+	// Bytes after the first NUL must be ignored.
+	if got := cString([]uint8("abc\x00def\x00")); got != "abc" {
+		t.Errorf("expected %q, got %q", "abc", got)
+	}
+
+	// A field without NUL uses all bytes.
+	if got := cString([]uint8("abc")); got != "abc" {
+		t.Errorf("expected %q, got %q", "abc", got)
+	}
+}
+
+func TestResponseTimes(t *testing.T) {
+	resp := &Response{
+		FirstSeen: 1700000000,
+		LastSeen:  1700000600,
+	}
+
+	if got := resp.FirstSeenTime(); !got.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("unexpected first seen time: %s", got)
+	}
+
+	if got := resp.LastSeenTime(); !got.Equal(time.Unix(1700000600, 0)) {
+		t.Errorf("unexpected last seen time: %s", got)
+	}
+
+	if got := resp.LastNatTime(); !got.IsZero() {
+		t.Errorf("expected zero last NAT time, got %s", got)
+	}
+
+	if got := resp.LastChgTime(); !got.IsZero() {
+		t.Errorf("expected zero last change time, got %s", got)
+	}
+}
+
+func TestResponseSeenDuration(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		firstSeen   uint32
+		lastSeen    uint32
+		expected    time.Duration
+	}{
+		{description: "both set", firstSeen: 1700000000, lastSeen: 1700000600, expected: 10 * time.Minute},
+		{description: "seen once", firstSeen: 1700000000, lastSeen: 1700000000, expected: 0},
+		{description: "no first seen", firstSeen: 0, lastSeen: 1700000600, expected: 0},
+		{description: "no last seen", firstSeen: 1700000000, lastSeen: 0, expected: 0},
+		{description: "last before first", firstSeen: 1700000600, lastSeen: 1700000000, expected: 0},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			resp := &Response{FirstSeen: test.firstSeen, LastSeen: test.lastSeen}
+			if got := resp.SeenDuration(); got != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestResponseObservations(t *testing.T) {
+	resp := &Response{TotalCount: 7}
+	if got := resp.Observations(); got != 7 {
+		t.Errorf("expected 7 observations, got %d", got)
+	}
+
+	if got := resp.Detailed(); !strings.Contains(got, "count=7") {
+		t.Errorf("expected count in %q", got)
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("could not marshal: %s", err)
+	}
+	if !strings.Contains(string(b), `"total_count":7`) {
+		t.Errorf("expected total_count in %s", b)
+	}
+}
+
+func TestResponseChangedSince(t *testing.T) {
+	baseline := time.Unix(1700000000, 0)
+
+	for _, test := range []struct {
+		description string
+		lastChg     uint32
+		expected    bool
+	}{
+		{description: "never changed", lastChg: 0, expected: false},
+		{description: "changed before", lastChg: 1600000000, expected: false},
+		{description: "changed at", lastChg: 1700000000, expected: false},
+		{description: "changed after", lastChg: 1700000001, expected: true},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			resp := &Response{LastChg: test.lastChg}
+			if got := resp.ChangedSince(baseline); got != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, got)
+			}
+		})
+	}
+
+	// The zero time as baseline must not turn "never" into a change.
+	if (&Response{}).ChangedSince(time.Time{}) {
+		t.Errorf("expected no change for a host that never changed")
+	}
+}
+
+func TestResponseUptime(t *testing.T) {
+	resp := &Response{}
+	if _, ok := resp.Uptime(); ok {
+		t.Errorf("expected no uptime data")
+	}
+
+	resp.UptimeMinutes = 90
+	resp.UpModDays = 49
+	uptime, ok := resp.Uptime()
+	if !ok {
+		t.Fatalf("expected uptime data")
+	}
+
+	if uptime != 90*time.Minute {
+		t.Errorf("expected 90m uptime, got %s", uptime)
+	}
+
+	if wrap := resp.UptimeWrap(); wrap != 49*24*time.Hour {
+		t.Errorf("expected 49 day wrap, got %s", wrap)
+	}
+}
+
+func TestResponseUptimeString(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		minutes     uint32
+		expected    string
+	}{
+		{description: "unknown", minutes: 0, expected: "unknown"},
+		{description: "minutes", minutes: 12, expected: "12m"},
+		{description: "hours", minutes: 90, expected: "1h 30m"},
+		{description: "days", minutes: (3*24+4)*60 + 12, expected: "3d 4h 12m"},
+		{description: "whole days", minutes: 2 * 24 * 60, expected: "2d 0h 0m"},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			resp := &Response{UptimeMinutes: test.minutes}
+			if got := resp.UptimeString(); got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestResponseMarshalJSON(t *testing.T) {
+	resp := &Response{
+		Magic:      P0F_RESPONSE_MAGIC,
+		Status:     P0F_STATUS_OK,
+		FirstSeen:  1700000000,
+		LastSeen:   1700000600,
+		TotalCount: 3,
+		Distance:   -1,
+		OsMatchQ:   P0F_MATCH_FUZZY,
+	}
+	copy(resp.OsName[:], "Linux")
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("could not marshal response: %s", err)
+	}
+
+	expected := `{"status":"ok","first_seen":"2023-11-14T22:13:20Z",` +
+		`"last_seen":"2023-11-14T22:23:20Z","total_count":3,"uptime_minutes":0,` +
+		`"up_mod_days":0,"distance":-1,"bad_sw":0,"match_quality":"fuzzy",` +
+		`"os_name":"Linux","os_flavor":"","http_name":"","http_flavor":"",` +
+		`"link_type":"","language":""}`
+	if string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+}
+
+func TestResponseStatus(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		status      Status
+		expected    string
+		isMatch     bool
+	}{
+		{
+			description: "ok",
+			status:      P0F_STATUS_OK,
+			expected:    "ok",
+			isMatch:     true,
+		},
+		{
+			description: "no match",
+			status:      P0F_STATUS_NOMATCH,
+			expected:    "nomatch",
+		},
+		{
+			description: "bad query",
+			status:      P0F_STATUS_BADQUERY,
+			expected:    "badquery",
+		},
+		{
+			description: "unknown",
+			status:      0x30,
+			expected:    "unknown",
+		},
+	} {
+
+		t.Run(test.description, func(t *testing.T) {
+			resp := &Response{Status: test.status}
+			if got := resp.StatusString(); got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+
+			if got := resp.IsMatch(); got != test.isMatch {
+				t.Errorf("expected IsMatch %t, got %t", test.isMatch, got)
+			}
+		})
+	}
+}
+
+func TestResponseMarshalJSONMatchQuality(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		osMatchQ    uint8
+		expected    string
+	}{
+		{
+			description: "exact",
+			osMatchQ:    0,
+			expected:    "none",
+		},
+		{
+			description: "fuzzy",
+			osMatchQ:    P0F_MATCH_FUZZY,
+			expected:    "fuzzy",
+		},
+		{
+			description: "generic",
+			osMatchQ:    P0F_MATCH_GENERIC,
+			expected:    "generic",
+		},
+		{
+			description: "fuzzy and generic",
+			osMatchQ:    P0F_MATCH_FUZZY | P0F_MATCH_GENERIC,
+			expected:    "fuzzy",
+		},
+	} {
+
+		t.Run(test.description, func(t *testing.T) {
+			data, err := json.Marshal(&Response{OsMatchQ: test.osMatchQ})
+			if err != nil {
+				t.Fatalf("could not marshal response: %s", err)
+			}
+
+			var decoded struct {
+				MatchQuality string `json:"match_quality"`
+			}
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("could not unmarshal response: %s", err)
+			}
+
+			if decoded.MatchQuality != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, decoded.MatchQuality)
+			}
+		})
+	}
+}
+
+func TestResponseSameFingerprint(t *testing.T) {
+	fingerprint := func(os, http string) *Response {
+		resp := &Response{}
+		copy(resp.OsName[:], os)
+		copy(resp.HttpName[:], http)
+		copy(resp.LinkType[:], "Ethernet or modem")
+		return resp
+	}
+
+	seen := fingerprint("Linux", "Firefox")
+	seen.TotalCount = 3
+	seen.LastSeen = 1700000000
+
+	for _, test := range []struct {
+		description string
+		other       *Response
+		expected    bool
+	}{
+		{
+			description: "only counters differ",
+			other:       fingerprint("Linux", "Firefox"),
+			expected:    true,
+		},
+		{
+			description: "os differs",
+			other:       fingerprint("Windows", "Firefox"),
+			expected:    false,
+		},
+		{
+			description: "http differs",
+			other:       fingerprint("Linux", "Chrome"),
+			expected:    false,
+		},
+		{
+			description: "nil",
+			other:       nil,
+			expected:    false,
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			if got := seen.SameFingerprint(test.other); got != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestResponseHopDistance(t *testing.T) {
+	for _, test := range []struct {
+		distance int16
+		expected int
+		valid    bool
+	}{
+		{distance: 0, expected: 0, valid: true},
+		{distance: 12, expected: 12, valid: true},
+		{distance: 255, expected: 255, valid: true},
+		{distance: -1, valid: false},
+		{distance: -2, valid: false},
+		{distance: 256, valid: false},
+		{distance: math.MaxInt16, valid: false},
+		{distance: math.MinInt16, valid: false},
+	} {
+		resp := &Response{Distance: test.distance}
+		d, ok := resp.HopDistance()
+		if ok != test.valid || d != test.expected {
+			t.Errorf("distance %d: expected %d (%t), got %d (%t)", test.distance, test.expected, test.valid, d, ok)
+		}
+	}
+}
+
+func TestResponseSoftwareMismatch(t *testing.T) {
+	for _, test := range []struct {
+		badSw    uint8
+		expected string
+	}{
+		{badSw: 0, expected: "none"},
+		{badSw: 1, expected: "likely"},
+		{badSw: 2, expected: "definite"},
+		{badSw: 3, expected: "unknown"},
+	} {
+		resp := &Response{BadSw: test.badSw}
+		if got := resp.SoftwareMismatch(); got != test.expected {
+			t.Errorf("BadSw %d: expected %q, got %q", test.badSw, test.expected, got)
+		}
+	}
+}
+
+func TestResponseDetailed(t *testing.T) {
+	resp := &Response{
+		Status:        P0F_STATUS_OK,
+		TotalCount:    3,
+		UptimeMinutes: 90,
+		Distance:      12,
+		OsMatchQ:      P0F_MATCH_FUZZY,
+	}
+	copy(resp.OsName[:], "Linux")
+	copy(resp.OsFlavor[:], "3.11 and newer")
+	copy(resp.HttpName[:], "Firefox")
+	copy(resp.LinkType[:], "Ethernet or modem")
+
+	expected := `os="Linux 3.11 and newer" quality=fuzzy http="Firefox" ` +
+		`link="Ethernet or modem" distance=12 uptime=1h30m0s count=3`
+	if got := resp.Detailed(); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	if got := (&Response{Distance: -1}).Detailed(); got != "" {
+		t.Errorf("expected empty string for an empty response, got %s", got)
+	}
+}
+
+func TestResponseTable(t *testing.T) {
+	resp := &Response{
+		Status:        P0F_STATUS_OK,
+		FirstSeen:     1700000000,
+		TotalCount:    3,
+		UptimeMinutes: 90,
+		UpModDays:     49,
+		Distance:      12,
+		OsMatchQ:      P0F_MATCH_FUZZY,
+	}
+	copy(resp.OsName[:], "Linux")
+	copy(resp.OsFlavor[:], "3.11 and newer")
+
+	expected := "status        ok\n" +
+		"os            Linux 3.11 and newer\n" +
+		"quality       fuzzy\n" +
+		"distance      12\n" +
+		"uptime        1h 30m\n" +
+		"uptime wrap   49 days\n" +
+		"observations  3\n" +
+		"first seen    2023-11-14T22:13:20Z\n"
+	if got := resp.Table(); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+
+	if got := (&Response{Status: P0F_STATUS_NOMATCH, Distance: -1}).Table(); got != "status  nomatch\n" {
+		t.Errorf("expected only the status for an empty response, got %q", got)
+	}
+}
+
+func TestResponseBehindNAT(t *testing.T) {
+	resp := &Response{}
+	if resp.BehindNAT() {
+		t.Errorf("expected host not to be behind NAT")
+	}
+
+	resp.LastNat = 1700000000
+	if !resp.BehindNAT() {
+		t.Errorf("expected host to be behind NAT")
+	}
+
+	if got := resp.LastNatTime(); !got.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("unexpected last NAT time: %s", got)
+	}
+}
+
+func TestResponseVerbose(t *testing.T) {
+	resp := &Response{OsMatchQ: P0F_MATCH_FUZZY}
+	copy(resp.OsName[:], "Linux")
+	copy(resp.OsFlavor[:], "3.x")
+	base := resp.String()
+
+	if got := resp.Verbose(); got != base {
+		t.Errorf("expected %q for an empty window, got %q", base, got)
+	}
+
+	resp.TotalCount = 3
+	resp.FirstSeen = 1700000000
+	resp.LastSeen = 1700000600
+	expected := base + ", seen 3 times between 2023-11-14T22:13:20Z and 2023-11-14T22:23:20Z"
+	if got := resp.Verbose(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestResponseMatchQuality(t *testing.T) {
+	for _, test := range []struct {
+		osMatchQ uint8
+		expected string
+	}{
+		{osMatchQ: 0, expected: "exact"},
+		{osMatchQ: P0F_MATCH_FUZZY, expected: "fuzzy"},
+		{osMatchQ: P0F_MATCH_GENERIC, expected: "generic"},
+		{osMatchQ: P0F_MATCH_FUZZY | P0F_MATCH_GENERIC, expected: "fuzzy,generic"},
+	} {
+		resp := &Response{OsMatchQ: test.osMatchQ}
+		if got := resp.MatchQuality(); got != test.expected {
+			t.Errorf("OsMatchQ %d: expected %q, got %q", test.osMatchQ, test.expected, got)
+		}
+	}
+}
+
+func TestResponseString(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		osName      string
+		osFlavor    string
+		osMatchQ    uint8
+		expected    string
+	}{
+		{
+			description: "exact",
+			osName:      "Linux",
+			osFlavor:    "3.x",
+			osMatchQ:    0,
+			expected:    "Linux 3.x (exact)",
+		},
+		{
+			description: "fuzzy",
+			osName:      "Linux",
+			osFlavor:    "3.x",
+			osMatchQ:    P0F_MATCH_FUZZY,
+			expected:    "Linux 3.x (fuzzy)",
+		},
+		{
+			description: "generic",
+			osName:      "Linux",
+			osFlavor:    "3.x",
+			osMatchQ:    P0F_MATCH_GENERIC,
+			expected:    "Linux 3.x (generic)",
+		},
+		{
+			description: "fuzzy and generic",
+			osName:      "Linux",
+			osFlavor:    "3.x",
+			osMatchQ:    P0F_MATCH_FUZZY | P0F_MATCH_GENERIC,
+			expected:    "Linux 3.x (fuzzy, generic)",
+		},
+		{
+			description: "no flavor",
+			osName:      "Windows",
+			expected:    "Windows (exact)",
+		},
+		{
+			description: "no os",
+			expected:    "(exact)",
+		},
+	} {
+
+		t.Run(test.description, func(t *testing.T) {
+			resp := &Response{OsMatchQ: test.osMatchQ}
+			copy(resp.OsName[:], test.osName)
+			copy(resp.OsFlavor[:], test.osFlavor)
+			if got := resp.String(); got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestResponseLinkClass(t *testing.T) {
+	for _, test := range []struct {
+		linkType string
+		expected LinkClass
+	}{
+		{linkType: "Ethernet or modem", expected: LinkEthernet},
+		{linkType: "DSL", expected: LinkDSL},
+		{linkType: "PPPoE", expected: LinkPPPoE},
+		{linkType: "GPRS, T1, FreeS/WAN", expected: LinkGPRS},
+		{linkType: "generic tunnel or VPN", expected: LinkUnknown},
+		{linkType: "", expected: LinkUnknown},
+	} {
+		resp := &Response{}
+		copy(resp.LinkType[:], test.linkType)
+		if got := resp.LinkClass(); got != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.linkType, test.expected, got)
+		}
+	}
+}
+
+func TestResponseOSFamily(t *testing.T) {
+	for _, test := range []struct {
+		osName   string
+		expected string
+	}{
+		{osName: "Linux", expected: "linux"},
+		{osName: "Windows", expected: "windows"},
+		{osName: "Mac OS X", expected: "macos"},
+		{osName: "FreeBSD", expected: "bsd"},
+		{osName: "openbsd", expected: "bsd"},
+		{osName: "Solaris", expected: "other"},
+		{osName: "", expected: "other"},
+	} {
+		resp := &Response{}
+		copy(resp.OsName[:], test.osName)
+		if got := resp.OSFamily(); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.osName, test.expected, got)
+		}
+	}
+}
+
+func TestResponseOSFamilyCustom(t *testing.T) {
+	defer func(families []OSFamilyPrefix) { OSFamilies = families }(OSFamilies)
+	OSFamilies = append([]OSFamilyPrefix{{Prefix: "Solaris", Family: "unix"}}, OSFamilies...)
+
+	resp := &Response{}
+	copy(resp.OsName[:], "Solaris")
+	if got := resp.OSFamily(); got != "unix" {
+		t.Errorf("expected %q, got %q", "unix", got)
+	}
+}
+
+func TestResponseLanguageTag(t *testing.T) {
+	for _, test := range []struct {
+		language string
+		expected string
+		ok       bool
+	}{
+		{language: "English", expected: "en", ok: true},
+		{language: "german", expected: "de", ok: true},
+		{language: "EN", expected: "en", ok: true},
+		{language: "pt_br", expected: "pt-BR", ok: true},
+		{language: "", expected: "", ok: false},
+		{language: "Klingon", expected: "", ok: false},
+		{language: "en-1234", expected: "", ok: false},
+	} {
+		resp := &Response{}
+		copy(resp.Language[:], test.language)
+		tag, ok := resp.LanguageTag()
+		if tag != test.expected || ok != test.ok {
+			t.Errorf("%q: expected %q (%t), got %q (%t)", test.language, test.expected, test.ok, tag, ok)
+		}
+	}
+}
+
+func TestResponseConfidence(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		response    Response
+		expected    int
+	}{
+		{
+			description: "no match",
+			response:    Response{Status: P0F_STATUS_NOMATCH, TotalCount: 10},
+			expected:    0,
+		},
+		{
+			description: "exact match seen often",
+			response:    Response{Status: P0F_STATUS_OK, TotalCount: 10},
+			expected:    100,
+		},
+		{
+			description: "exact match never counted",
+			response:    Response{Status: P0F_STATUS_OK, TotalCount: 0},
+			expected:    80,
+		},
+		{
+			description: "exact match seen once",
+			response:    Response{Status: P0F_STATUS_OK, TotalCount: 1},
+			expected:    80,
+		},
+		{
+			description: "exact match seen twice",
+			response:    Response{Status: P0F_STATUS_OK, TotalCount: 2},
+			expected:    90,
+		},
+		{
+			description: "exact match seen a few times",
+			response:    Response{Status: P0F_STATUS_OK, TotalCount: 3},
+			expected:    90,
+		},
+		{
+			description: "exact match seen 5 times",
+			response:    Response{Status: P0F_STATUS_OK, TotalCount: 5},
+			expected:    100,
+		},
+		{
+			description: "fuzzy generic match seen once",
+			response:    Response{Status: P0F_STATUS_OK, OsMatchQ: P0F_MATCH_FUZZY | P0F_MATCH_GENERIC, TotalCount: 1},
+			expected:    30,
+		},
+		{
+			description: "never below zero",
+			response:    Response{Status: P0F_STATUS_OK, OsMatchQ: P0F_MATCH_FUZZY | P0F_MATCH_GENERIC, BadSw: 2},
+			expected:    0,
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			if got := test.response.Confidence(); got != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package p0fclient
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// QueryResult is the outcome of querying a single IP address. Either
+// Response or Err is set.
+type QueryResult struct {
+	IP net.IP
+	// AddressType is the address type the query was sent with. p0f does not
+	// echo the address, so this tells for example whether an IPv4-mapped
+	// IPv6 address was queried as IPv4 or IPv6. It is 0 if no query was
+	// created for IP, for example because it is nil or unspecified.
+	AddressType AddressType
+	Response    *Response
+	Err         error
+}
+
+// QueryIPResult is like QueryIP but returns the outcome as a QueryResult,
+// which also records the address and address type that were queried.
+func (p *P0fClient) QueryIPResult(ip net.IP) QueryResult {
+	return p.queryIPResult(context.Background(), ip)
+}
+
+// QueryIPResults is like QueryIPs but returns a QueryResult for every
+// address, in the same order as ips, instead of parallel slices.
+func (p *P0fClient) QueryIPResults(ips []net.IP) []QueryResult {
+	return p.QueryIPResultsContext(context.Background(), ips)
+}
+
+// QueryIPResultsContext is like QueryIPsContext but returns a QueryResult
+// for every address, in the same order as ips, instead of parallel slices.
+func (p *P0fClient) QueryIPResultsContext(ctx context.Context, ips []net.IP) []QueryResult {
+	sent := make([]AddressType, len(ips))
+	responses, errs := p.queryIPs(ctx, ips, sent)
+
+	results := make([]QueryResult, len(ips))
+	for i, ip := range ips {
+		results[i] = QueryResult{IP: ip, AddressType: sent[i], Response: responses[i], Err: errs[i]}
+	}
+	return results
+}
+
+// queryIPResult queries ip and returns the outcome as a QueryResult.
+func (p *P0fClient) queryIPResult(ctx context.Context, ip net.IP) QueryResult {
+	var sent Query
+	result := QueryResult{IP: ip, Response: &Response{}}
+	result.Err = p.queryIPInto(ctx, ip, result.Response, queryOptions{cached: true, sent: &sent})
+	if result.Err != nil {
+		result.Response = nil
+	}
+	result.AddressType = sent.AddressType
+	return result
+}
+
+// StartStream starts a goroutine that queries p0f for every IP address read
+// from in and sends the result to out, in the same order. All queries use
+// the connection of the client. The goroutine ends, and closes out, once in
+// is closed or the client is stopped; the query that noticed the client was
+// stopped is sent with ErrNotConnected.
+func (p *P0fClient) StartStream(in <-chan net.IP, out chan<- QueryResult) {
+	p.StartStreamContext(context.Background(), in, out)
+}
+
+// StartStreamContext is like StartStream but the goroutine also ends when
+// the context is done. A query that is in flight when the context is done is
+// not interrupted: it is finished so that the connection stays in sync with
+// p0f and can be reused, but its result is not sent to out. Use SetTimeout
+// to bound how long that can take.
+func (p *P0fClient) StartStreamContext(ctx context.Context, in <-chan net.IP, out chan<- QueryResult) {
+	go func() {
+		defer close(out)
+
+		for {
+			var ip net.IP
+			select {
+			case <-ctx.Done():
+				return
+			case addr, ok := <-in:
+				if !ok {
+					return
+				}
+				ip = addr
+			}
+
+			result := p.queryIPResult(context.WithoutCancel(ctx), ip)
+			if ctx.Err() != nil {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case out <- result:
+			}
+
+			if errors.Is(result.Err, ErrNotConnected) {
+				return
+			}
+		}
+	}()
+}
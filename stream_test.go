@@ -0,0 +1,232 @@
+package p0fclient
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestP0fStartStream(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	in := make(chan net.IP)
+	out := make(chan QueryResult)
+	pc.StartStream(in, out)
+
+	ips := []net.IP{net.ParseIP("10.0.0.1"), nil, net.ParseIP("10.0.0.2")}
+	go func() {
+		for _, ip := range ips {
+			in <- ip
+		}
+		close(in)
+	}()
+
+	var results []QueryResult
+	for result := range out {
+		results = append(results, result)
+	}
+
+	if len(results) != len(ips) {
+		t.Fatalf("expected %d results, got %d", len(ips), len(results))
+	}
+	for i, result := range results {
+		if !result.IP.Equal(ips[i]) {
+			t.Errorf("expected IP %s at index %d, got %s", ips[i], i, result.IP)
+		}
+		if expected := []AddressType{P0F_ADDR_IPV4, 0, P0F_ADDR_IPV4}[i]; result.AddressType != expected {
+			t.Errorf("expected address type %s at index %d, got %s", expected, i, result.AddressType)
+		}
+		if expectError := ips[i] == nil; (result.Err != nil) != expectError {
+			t.Errorf("unexpected error at index %d: %v", i, result.Err)
+		}
+	}
+}
+
+func TestP0fQueryIPResult(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	for _, test := range []struct {
+		description  string
+		ip           string
+		mappedAsIPv6 bool
+		expected     AddressType
+	}{
+		{description: "ipv4", ip: "192.0.2.1", expected: P0F_ADDR_IPV4},
+		{description: "ipv6", ip: "2001:db8::1", expected: P0F_ADDR_IPV6},
+		{description: "mapped as ipv4", ip: "::ffff:192.0.2.1", expected: P0F_ADDR_IPV4},
+		{description: "mapped as ipv6", ip: "::ffff:192.0.2.1", mappedAsIPv6: true, expected: P0F_ADDR_IPV6},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			pc := NewP0fClient(socket, WithMappedAsIPv6(test.mappedAsIPv6))
+			if err := pc.Connect(); err != nil {
+				t.Fatalf("could not connect: %s", err)
+			}
+			defer pc.Stop()
+
+			ip := net.ParseIP(test.ip)
+			result := pc.QueryIPResult(ip)
+			if result.Err != nil {
+				t.Fatalf("expected no error, got %s", result.Err)
+			}
+			if !result.IP.Equal(ip) || result.Response == nil {
+				t.Errorf("unexpected result %+v", result)
+			}
+			if result.AddressType != test.expected {
+				t.Errorf("expected address type %s, got %s", test.expected, result.AddressType)
+			}
+		})
+	}
+}
+
+func TestP0fQueryIPResults(t *testing.T) {
+	socket := startTestServer(t, func(conn net.Conn) {
+		answerQueries(conn, okResponse)
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	ips := []net.IP{net.ParseIP("192.0.2.1"), nil, net.ParseIP("2001:db8::1")}
+	results := pc.QueryIPResults(ips)
+	if len(results) != len(ips) {
+		t.Fatalf("expected %d results, got %d", len(ips), len(results))
+	}
+
+	for i, expected := range []AddressType{P0F_ADDR_IPV4, 0, P0F_ADDR_IPV6} {
+		result := results[i]
+		if !result.IP.Equal(ips[i]) {
+			t.Errorf("expected IP %s at index %d, got %s", ips[i], i, result.IP)
+		}
+		if result.AddressType != expected {
+			t.Errorf("expected address type %s at index %d, got %s", expected, i, result.AddressType)
+		}
+		if failed := ips[i] == nil; (result.Err != nil) != failed || (result.Response == nil) != failed {
+			t.Errorf("unexpected result at index %d: %+v", i, result)
+		}
+	}
+}
+
+func TestP0fQueryIPResultRejected(t *testing.T) {
+	pc := newP0fClientRW(&bufferPair{})
+
+	result := pc.QueryIPResult(net.ParseIP("0.0.0.0"))
+	if !errors.Is(result.Err, ErrUnspecifiedIP) {
+		t.Errorf("expected ErrUnspecifiedIP, got %v", result.Err)
+	}
+	if result.AddressType != 0 || result.Response != nil {
+		t.Errorf("expected no address type and no response for a query that was not sent, got %+v", result)
+	}
+
+	results := pc.QueryIPResults([]net.IP{net.ParseIP("::")})
+	if results[0].AddressType != 0 {
+		t.Errorf("expected no address type for a query that was not sent, got %s", results[0].AddressType)
+	}
+}
+
+func TestP0fStartStreamStop(t *testing.T) {
+	pc := NewP0fClient("/tmp/unused.sock")
+
+	in := make(chan net.IP, 1)
+	out := make(chan QueryResult, 1)
+	pc.StartStream(in, out)
+
+	in <- net.ParseIP("10.0.0.1")
+	result := <-out
+	if !errors.Is(result.Err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected, got %v", result.Err)
+	}
+	if _, ok := <-out; ok {
+		t.Errorf("expected out to be closed")
+	}
+}
+
+func TestP0fStartStreamContext(t *testing.T) {
+	pc := NewP0fClient("/tmp/unused.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan QueryResult)
+	pc.StartStreamContext(ctx, make(chan net.IP), out)
+	cancel()
+
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Errorf("expected out to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("stream did not end after cancelling the context")
+	}
+}
+
+func TestP0fStartStreamContextDrain(t *testing.T) {
+	received := make(chan struct{}, 2)
+	socket := startTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		var query Query
+		for count := uint32(1); binary.Read(conn, binary.LittleEndian, &query) == nil; count++ {
+			received <- struct{}{}
+			time.Sleep(50 * time.Millisecond)
+
+			resp := okResponse
+			resp.TotalCount = count
+			if binary.Write(conn, binary.LittleEndian, resp) != nil {
+				return
+			}
+		}
+	})
+
+	pc := NewP0fClient(socket)
+	if err := pc.Connect(); err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer pc.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan net.IP, 1)
+	out := make(chan QueryResult, 1)
+	pc.StartStreamContext(ctx, in, out)
+
+	// Cancel while p0f is still answering the query.
+	in <- net.ParseIP("192.0.2.1")
+	<-received
+	cancel()
+
+	select {
+	case result, ok := <-out:
+		if ok {
+			t.Errorf("expected out to be closed, got %+v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("stream did not end after cancelling the context")
+	}
+
+	// The in-flight query was read completely, so the next query gets its
+	// own answer over the same connection.
+	if !pc.IsConnected() {
+		t.Fatalf("expected the connection to be kept")
+	}
+	resp, err := pc.QueryIP(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if resp.TotalCount != 2 {
+		t.Errorf("expected the answer to the second query, got count %d", resp.TotalCount)
+	}
+}
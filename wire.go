@@ -0,0 +1,73 @@
+package p0fclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// NewQuery returns the query for the IP address. IPv4-mapped IPv6 addresses
+// are queried as IPv4. Together with WriteQuery and ReadResponse it allows
+// managing the connection to p0f outside of P0fClient.
+func NewQuery(ip net.IP) (Query, error) {
+	return createQueryForIP(ip)
+}
+
+// WriteQuery writes q to w in the wire format of p0f. It returns ErrBadMagic
+// if q does not carry P0F_REQUEST_MAGIC.
+func WriteQuery(w io.Writer, q Query) error {
+	if q.Magic != P0F_REQUEST_MAGIC {
+		return fmt.Errorf("%w: query magic %#x", ErrBadMagic, q.Magic)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, q); err != nil {
+		return fmt.Errorf("could not write query: %w", err)
+	}
+	return nil
+}
+
+// ReadResponse reads a single response in the wire format of p0f from r. It
+// returns ErrBadMagic if the response does not carry P0F_RESPONSE_MAGIC, or
+// ErrBigEndian if it was sent in big-endian byte order. The status of the
+// response is not interpreted; check it with IsMatch or the Status field.
+//
+// The p0f protocol has no length field: a response is assumed to be exactly
+// ResponseSize bytes laid out as in Response. The magic is the only check
+// that the layout matches, so a p0f that changes the layout without changing
+// the magic cannot be detected. If fewer bytes arrive the error reports how
+// many were read. Use ReadResponseSize if p0f is known to send larger
+// responses.
+func ReadResponse(r io.Reader) (*Response, error) {
+	return ReadResponseSize(r, ResponseSize)
+}
+
+// ReadResponseSize is like ReadResponse but reads responses of size bytes
+// from r, such as those of a p0f version that appends fields to the
+// response. The first ResponseSize bytes are decoded and the rest is
+// discarded so that r stays positioned at the start of the next response.
+// The size must be at least ResponseSize.
+func ReadResponseSize(r io.Reader, size int) (*Response, error) {
+	if size < ResponseSize {
+		return nil, fmt.Errorf("response size %d is smaller than the %d bytes of a response", size, ResponseSize)
+	}
+
+	buf := make([]byte, size)
+	if n, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("could not read response: got %d of %d bytes: %w", n, size, err)
+	}
+
+	resp := &Response{}
+	if err := binary.Read(bytes.NewReader(buf[:ResponseSize]), binary.LittleEndian, resp); err != nil {
+		return nil, fmt.Errorf("could not convert response: %w", err)
+	}
+
+	if resp.Magic != P0F_RESPONSE_MAGIC {
+		if isBigEndianMagic(resp.Magic, P0F_RESPONSE_MAGIC) {
+			return nil, ErrBigEndian
+		}
+		return nil, fmt.Errorf("%w: unexpected response magic %#x, possible p0f version mismatch", ErrBadMagic, resp.Magic)
+	}
+	return resp, nil
+}
@@ -0,0 +1,132 @@
+package p0fclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestWriteQuery(t *testing.T) {
+	q, err := NewQuery(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("could not create query: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteQuery(&buf, q); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	var expected bytes.Buffer
+	if _, err := encodeQuery(&expected, net.ParseIP("192.0.2.1"), false, P0F_REQUEST_MAGIC); err != nil {
+		t.Fatalf("could not encode query: %s", err)
+	}
+	if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+		t.Errorf("expected % x, got % x", expected.Bytes(), buf.Bytes())
+	}
+
+	q.Magic = 1
+	if err := WriteQuery(&buf, q); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("expected ErrBadMagic, got %v", err)
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	expected := okResponse
+	copy(expected.OsName[:], "Linux")
+
+	for _, test := range []struct {
+		description string
+		response    Response
+		truncate    int
+		err         error
+	}{
+		{
+			description: "valid",
+			response:    expected,
+		},
+		{
+			description: "bad magic",
+			response:    Response{Magic: 1},
+			err:         ErrBadMagic,
+		},
+		{
+			description: "big-endian",
+			response:    Response{Magic: 0x02463050},
+			err:         ErrBigEndian,
+		},
+		{
+			description: "short",
+			response:    expected,
+			truncate:    10,
+			err:         io.ErrUnexpectedEOF,
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			var buf bytes.Buffer
+			binary.Write(&buf, binary.LittleEndian, test.response)
+			buf.Truncate(buf.Len() - test.truncate)
+
+			resp, err := ReadResponse(&buf)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Errorf("expected %v, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if *resp != test.response {
+				t.Errorf("expected %+v, got %+v", test.response, resp)
+			}
+		})
+	}
+}
+
+func TestReadResponseSize(t *testing.T) {
+	first, second := okResponse, okResponse
+	copy(first.OsName[:], "Linux")
+	copy(second.OsName[:], "Windows")
+
+	var buf bytes.Buffer
+	for _, resp := range []Response{first, second} {
+		binary.Write(&buf, binary.LittleEndian, resp)
+		buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	}
+
+	for _, expected := range []Response{first, second} {
+		resp, err := ReadResponseSize(&buf, ResponseSize+4)
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if *resp != expected {
+			t.Errorf("expected %+v, got %+v", expected, resp)
+		}
+	}
+
+	if _, err := ReadResponseSize(&buf, ResponseSize-1); err == nil {
+		t.Errorf("expected an error for a size below ResponseSize")
+	}
+}
+
+func TestReadResponseShortCount(t *testing.T) {
+	_, err := ReadResponse(bytes.NewReader(make([]byte, 10)))
+	if err == nil || !strings.Contains(err.Error(), "got 10 of 232 bytes") {
+		t.Errorf("expected the byte count in the error, got %v", err)
+	}
+}
+
+func TestWireSizes(t *testing.T) {
+	if size := binary.Size(Query{}); size != QuerySize {
+		t.Errorf("QuerySize is %d but a Query takes %d bytes", QuerySize, size)
+	}
+	if size := binary.Size(Response{}); size != ResponseSize {
+		t.Errorf("ResponseSize is %d but a Response takes %d bytes", ResponseSize, size)
+	}
+}